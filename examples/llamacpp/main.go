@@ -7,9 +7,11 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/soypete/pedro-ops/metrics"
+	"github.com/soypete/pedro-ops/types"
 )
 
 type ChatRequest struct {
@@ -59,6 +61,7 @@ func main() {
 
 	// Make the request
 	client := &http.Client{}
+	startTime := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Fatalf("Error making request: %v", err)
@@ -76,7 +79,12 @@ func main() {
 
 	// Parse response
 	metricsCalculator := metrics.SetupCalculator()
-	responseMetrics, derrivedMetrics, err := metricsCalculator.CalculateMetrics(body)
+	responseMetrics, derrivedMetrics, err := metricsCalculator.CalculateMetrics(body,
+		metrics.WithStartTime(startTime),
+		metrics.WithEndpoint(types.EndpointChatCompletions),
+		metrics.WithStatusCode(resp.StatusCode),
+		metrics.WithRequestSize(int64(len(jsonData))),
+	)
 	if err != nil {
 		log.Fatalf("Error calculating metrics: %v", err)
 	}
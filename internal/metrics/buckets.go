@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// msPerSecond converts the millisecond values of ResponseMetrics.CalculateMetrics to the
+// base unit seconds used by the histograms.
+const msPerSecond = 1000
+
+// Default buckets, in seconds, sized for llm inference rather than typical web requests.
+var (
+	// latencyBuckets cover whole requests and generation, from fast embeddings to
+	// multi minute reasoning completions.
+	latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300, 600}
+	// firstTokenBuckets cover time to first token and prompt processing of long contexts.
+	firstTokenBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+	// overheadBuckets cover time spent outside of inference, e.g. the network over Tailscale.
+	overheadBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+	// interTokenBuckets cover the gap between streamed tokens.
+	interTokenBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.02, 0.03, 0.05, 0.075, 0.1, 0.25, 0.5, 1}
+	// throughputBuckets cover decode speeds in tokens per second.
+	throughputBuckets = []float64{1, 2.5, 5, 10, 15, 20, 30, 40, 50, 75, 100, 150, 200, 300, 500}
+)
+
+// throughputObjectives are the quantiles of the optional tokens per second summary.
+var throughputObjectives = map[float64]float64{0.5: 0.05, 0.95: 0.01, 0.99: 0.001}
+
+// histogramConfig holds the histogram settings configured with ClientOptions.
+type histogramConfig struct {
+	buckets            map[string][]float64
+	nativeBucketFactor float64
+	throughputSummary  bool
+}
+
+// histogramOpts applies the configured bucket overrides and native histogram settings to opts.
+func (c *Client) histogramOpts(opts prometheus.HistogramOpts) prometheus.HistogramOpts {
+	if buckets, ok := c.histograms.buckets[opts.Name]; ok {
+		opts.Buckets = buckets
+	}
+	if c.histograms.nativeBucketFactor > 1 {
+		opts.NativeHistogramBucketFactor = c.histograms.nativeBucketFactor
+		opts.NativeHistogramMaxBucketNumber = 160
+		opts.NativeHistogramMinResetDuration = time.Hour
+	}
+	return opts
+}
+
+// seconds converts milliseconds to seconds.
+func seconds(ms float64) float64 {
+	return ms / msPerSecond
+}
@@ -3,44 +3,98 @@ package metrics
 import (
 	"expvar"
 	"fmt"
+	"net/http"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
-	"github.com/soypete/pedro-ops/internal/types"
+	"github.com/soypete/pedro-ops/internal/middleware"
+	"github.com/soypete/pedro-ops/types"
 )
 
+// unknownModel is the model label used when the model could not be read from the response.
+const unknownModel = "unknown"
+
 // Client handles both Prometheus and expvar metrics
 type Client struct {
+	factory    promauto.Factory
+	handler    http.Handler
+	histograms histogramConfig
+	labels     *labelLimiter
+	// clientLabel is set when the request and token counters have a client label.
+	clientLabel bool
+	// upstreamLabel is set when the request, error and latency metrics have an upstream label.
+	upstreamLabel bool
+	// requestLabels are the names of the caller supplied labels of the request counter.
+	requestLabels []string
+	pricing       Pricing
+
 	// Prometheus metrics
 	apiLatency       *prometheus.HistogramVec
 	timeToFirstToken *prometheus.HistogramVec
 	promptProcessing *prometheus.HistogramVec
 	tokenGeneration  *prometheus.HistogramVec
-	tokensPerSecond  *prometheus.GaugeVec
 	requestCounter   *prometheus.CounterVec
+	parseErrors      *prometheus.CounterVec
+	apiErrors        *prometheus.CounterVec
+	finishReasons    *prometheus.CounterVec
+	substitutions    *prometheus.CounterVec
 	tokenCounter     *prometheus.CounterVec
+	cacheHitRatio    *prometheus.HistogramVec
 	requestSize      *prometheus.HistogramVec
 	responseSize     *prometheus.HistogramVec
 
+	// Throughput metrics
+	tokensPerSecond   *prometheus.HistogramVec
+	interTokenLatency *prometheus.HistogramVec
+	// tokensPerSecondSummary is only set with WithThroughputSummary.
+	tokensPerSecondSummary *prometheus.SummaryVec
+
+	// llama.cpp server reported timings
+	serverPromptProcessing *prometheus.HistogramVec
+	serverTokenGeneration  *prometheus.HistogramVec
+	serverPromptSpeed      *prometheus.HistogramVec
+	serverGenerationSpeed  *prometheus.HistogramVec
+	networkOverhead        *prometheus.HistogramVec
+
+	// Cost metrics
+	cost *prometheus.CounterVec
+
+	// Tool calling metrics
+	toolCalls            *prometheus.CounterVec
+	toolCallsPerResponse *prometheus.HistogramVec
+	toolCallResponses    *prometheus.CounterVec
+
+	// Proxy metrics
+	budgetRemaining  *prometheus.GaugeVec
+	rejectedRequests *prometheus.CounterVec
+	circuitState     *prometheus.GaugeVec
+	upstreamRetries  *prometheus.CounterVec
+
 	// Expvar metrics
-	expvarMutex   sync.RWMutex
-	requestCounts map[string]*expvar.Int
-	errorCounts   map[string]*expvar.Int
-	avgLatency    map[string]*expvar.Float
-	avgTTFT       map[string]*expvar.Float
+	expvarStats *windowedStats
 }
 
-// NewClient creates a new metrics client with both Prometheus and expvar support
-func NewClient() *Client {
+// NewClient creates a new metrics client with both Prometheus and expvar support. By default
+// the Prometheus metrics are registered with a new registry owned by the client, so any number
+// of clients can be created in one process; use WithRegisterer to share a registry.
+func NewClient(opts ...ClientOption) *Client {
+	cfg := newClientConfig(opts)
 	client := &Client{
-		requestCounts: make(map[string]*expvar.Int),
-		errorCounts:   make(map[string]*expvar.Int),
-		avgLatency:    make(map[string]*expvar.Float),
-		avgTTFT:       make(map[string]*expvar.Float),
+		factory:       promauto.With(cfg.wrappedRegisterer()),
+		handler:       metricsHandler(cfg.gatherer),
+		histograms:    cfg.histograms,
+		clientLabel:   cfg.labels.client,
+		upstreamLabel: cfg.labels.upstream,
+		requestLabels: cfg.labels.requestLabels,
+		pricing:       cfg.pricing,
+		expvarStats:   sharedExpvarStats(),
 	}
 
+	client.labels = client.newLabelLimiter(cfg.labels)
 	client.initPrometheusMetrics()
 	client.initExpvarMetrics()
 
@@ -50,98 +104,372 @@ func NewClient() *Client {
 func (c *Client) initPrometheusMetrics() {
 	c.initPrometheusHistograms()
 	c.initPrometheusCountersAndSizes()
+	c.initPrometheusToolMetrics()
+	c.initPrometheusServerTimings()
+	c.initPrometheusProxyMetrics()
 }
 
 func (c *Client) initPrometheusHistograms() {
-	c.apiLatency = promauto.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "openai_api_latency_milliseconds",
-			Help:    "API latency in milliseconds",
-			Buckets: prometheus.DefBuckets,
-		},
-		[]string{"model", "endpoint"},
+	c.apiLatency = c.factory.NewHistogramVec(
+		c.histogramOpts(prometheus.HistogramOpts{
+			Name:    "openai_api_latency_seconds",
+			Help:    "API latency in seconds",
+			Buckets: latencyBuckets,
+		}),
+		c.withUpstreamLabel("model", "endpoint"),
 	)
 
-	c.timeToFirstToken = promauto.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "openai_time_to_first_token_milliseconds",
-			Help:    "Time to first token in milliseconds",
-			Buckets: prometheus.DefBuckets,
-		},
+	c.timeToFirstToken = c.factory.NewHistogramVec(
+		c.histogramOpts(prometheus.HistogramOpts{
+			Name:    "openai_time_to_first_token_seconds",
+			Help:    "Time to first token in seconds",
+			Buckets: firstTokenBuckets,
+		}),
+		c.withUpstreamLabel("model", "endpoint"),
+	)
+
+	c.promptProcessing = c.factory.NewHistogramVec(
+		c.histogramOpts(prometheus.HistogramOpts{
+			Name:    "openai_prompt_processing_seconds",
+			Help:    "Prompt processing time in seconds",
+			Buckets: firstTokenBuckets,
+		}),
 		[]string{"model", "endpoint"},
 	)
 
-	c.promptProcessing = promauto.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "openai_prompt_processing_milliseconds",
-			Help:    "Prompt processing time in milliseconds",
-			Buckets: prometheus.DefBuckets,
-		},
+	c.tokenGeneration = c.factory.NewHistogramVec(
+		c.histogramOpts(prometheus.HistogramOpts{
+			Name:    "openai_token_generation_seconds",
+			Help:    "Token generation time in seconds",
+			Buckets: latencyBuckets,
+		}),
 		[]string{"model", "endpoint"},
 	)
 
-	c.tokenGeneration = promauto.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "openai_token_generation_milliseconds",
-			Help:    "Token generation time in milliseconds",
-			Buckets: prometheus.DefBuckets,
-		},
+	c.tokensPerSecond = c.factory.NewHistogramVec(
+		c.histogramOpts(prometheus.HistogramOpts{
+			Name:    "openai_tokens_per_second",
+			Help:    "Decode throughput in tokens per second, from server timings or streamed responses",
+			Buckets: throughputBuckets,
+		}),
 		[]string{"model", "endpoint"},
 	)
 
-	c.tokensPerSecond = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "openai_tokens_per_second",
-			Help: "Tokens generated per second",
-		},
+	if c.histograms.throughputSummary {
+		c.tokensPerSecondSummary = c.factory.NewSummaryVec(
+			prometheus.SummaryOpts{
+				Name:       "openai_tokens_per_second_summary",
+				Help:       "Decode throughput in tokens per second, from server timings or streamed responses",
+				Objectives: throughputObjectives,
+			},
+			[]string{"model", "endpoint"},
+		)
+	}
+
+	c.interTokenLatency = c.factory.NewHistogramVec(
+		c.histogramOpts(prometheus.HistogramOpts{
+			Name:    "openai_inter_token_latency_seconds",
+			Help:    "Time between consecutive tokens of streamed responses in seconds",
+			Buckets: interTokenBuckets,
+		}),
 		[]string{"model", "endpoint"},
 	)
 }
 
 func (c *Client) initPrometheusCountersAndSizes() {
-	c.requestCounter = promauto.NewCounterVec(
+	c.requestCounter = c.factory.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "openai_requests_total",
 			Help: "Total number of OpenAI API requests",
 		},
-		[]string{"model", "endpoint", "status"},
+		c.withRequestLabels(c.withUpstreamLabel(c.withClientLabel("model", "endpoint", "status")...)...),
+	)
+
+	c.parseErrors = c.factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "openai_parse_errors_total",
+			Help: "Total number of responses that metrics could not be extracted from",
+		},
+		[]string{"endpoint", "reason"},
+	)
+
+	c.apiErrors = c.factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "openai_errors_total",
+			Help: "Total number of failed requests by error type",
+		},
+		c.withUpstreamLabel("model", "endpoint", "status", "error_type"),
+	)
+
+	c.finishReasons = c.factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "openai_finish_reasons_total",
+			Help: "Total number of completions by finish reason",
+		},
+		[]string{"model", "endpoint", "finish_reason"},
+	)
+
+	c.cost = c.factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "openai_cost_dollars_total",
+			Help: "Total cost in dollars of the tokens and local inference time used, from the pricing table",
+		},
+		[]string{"model", "client"},
 	)
 
-	c.tokenCounter = promauto.NewCounterVec(
+	c.substitutions = c.factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "openai_model_substitutions_total",
+			Help: "Total number of responses served by a different model than requested",
+		},
+		[]string{"requested_model", "model", "endpoint"},
+	)
+
+	c.tokenCounter = c.factory.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "openai_tokens_total",
 			Help: "Total number of tokens processed",
 		},
-		[]string{"model", "endpoint", "type"},
+		c.withClientLabel("model", "endpoint", "type"),
+	)
+
+	c.cacheHitRatio = c.factory.NewHistogramVec(
+		c.histogramOpts(prometheus.HistogramOpts{
+			Name:    "openai_prompt_cache_hit_ratio",
+			Help:    "Fraction of prompt tokens served from the prompt cache",
+			Buckets: prometheus.LinearBuckets(0.1, 0.1, 10),
+		}),
+		[]string{"model", "endpoint"},
 	)
 
-	c.requestSize = promauto.NewHistogramVec(
-		prometheus.HistogramOpts{
+	c.requestSize = c.factory.NewHistogramVec(
+		c.histogramOpts(prometheus.HistogramOpts{
 			Name:    "openai_request_size_bytes",
 			Help:    "Request size in bytes",
 			Buckets: prometheus.ExponentialBuckets(100, 2, 10),
-		},
+		}),
 		[]string{"model", "endpoint"},
 	)
 
-	c.responseSize = promauto.NewHistogramVec(
-		prometheus.HistogramOpts{
+	c.responseSize = c.factory.NewHistogramVec(
+		c.histogramOpts(prometheus.HistogramOpts{
 			Name:    "openai_response_size_bytes",
 			Help:    "Response size in bytes",
 			Buckets: prometheus.ExponentialBuckets(100, 2, 10),
+		}),
+		[]string{"model", "endpoint"},
+	)
+}
+
+func (c *Client) initPrometheusToolMetrics() {
+	c.toolCalls = c.factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "openai_tool_calls_total",
+			Help: "Total number of tool calls requested by the model",
+		},
+		[]string{"model", "endpoint", "tool"},
+	)
+
+	c.toolCallsPerResponse = c.factory.NewHistogramVec(
+		c.histogramOpts(prometheus.HistogramOpts{
+			Name:    "openai_tool_calls_per_response",
+			Help:    "Number of tool calls in responses that called tools",
+			Buckets: prometheus.LinearBuckets(1, 1, 8),
+		}),
+		[]string{"model", "endpoint"},
+	)
+
+	c.toolCallResponses = c.factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "openai_tool_call_responses_total",
+			Help: "Total number of responses with finish_reason tool_calls",
 		},
 		[]string{"model", "endpoint"},
 	)
 }
 
+func (c *Client) initPrometheusServerTimings() {
+	c.serverPromptProcessing = c.factory.NewHistogramVec(
+		c.histogramOpts(prometheus.HistogramOpts{
+			Name:    "openai_server_prompt_processing_seconds",
+			Help:    "Prompt processing time in seconds as reported by the llama.cpp server",
+			Buckets: firstTokenBuckets,
+		}),
+		[]string{"model", "endpoint"},
+	)
+
+	c.serverTokenGeneration = c.factory.NewHistogramVec(
+		c.histogramOpts(prometheus.HistogramOpts{
+			Name:    "openai_server_token_generation_seconds",
+			Help:    "Token generation time in seconds as reported by the llama.cpp server",
+			Buckets: latencyBuckets,
+		}),
+		[]string{"model", "endpoint"},
+	)
+
+	c.serverPromptSpeed = c.factory.NewHistogramVec(
+		c.histogramOpts(prometheus.HistogramOpts{
+			Name:    "openai_server_prompt_tokens_per_second",
+			Help:    "Prompt tokens processed per second as reported by the llama.cpp server",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+		}),
+		[]string{"model", "endpoint"},
+	)
+
+	c.serverGenerationSpeed = c.factory.NewHistogramVec(
+		c.histogramOpts(prometheus.HistogramOpts{
+			Name:    "openai_server_tokens_per_second",
+			Help:    "Tokens generated per second as reported by the llama.cpp server",
+			Buckets: throughputBuckets,
+		}),
+		[]string{"model", "endpoint"},
+	)
+
+	c.networkOverhead = c.factory.NewHistogramVec(
+		c.histogramOpts(prometheus.HistogramOpts{
+			Name:    "openai_network_overhead_seconds",
+			Help:    "API latency not spent on server side inference, in seconds",
+			Buckets: overheadBuckets,
+		}),
+		[]string{"model", "endpoint"},
+	)
+}
+
+func (c *Client) initPrometheusProxyMetrics() {
+	c.budgetRemaining = c.factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "openai_budget_remaining_tokens",
+			Help: "Tokens left in the client's budget for the current period",
+		},
+		[]string{"client", "period"},
+	)
+
+	c.rejectedRequests = c.factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "openai_rejected_requests_total",
+			Help: "Total number of requests rejected by the proxy before reaching the upstream",
+		},
+		[]string{"client", "model", "reason"},
+	)
+
+	c.circuitState = c.factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "openai_upstream_circuit_state",
+			Help: "State of the upstream's circuit breaker: 0 closed, 1 half open, 2 open",
+		},
+		[]string{"upstream"},
+	)
+
+	c.upstreamRetries = c.factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "openai_upstream_retries_total",
+			Help: "Total number of requests retried on or failed over to the upstream",
+		},
+		[]string{"upstream", "reason"},
+	)
+}
+
+// RecordRejection counts a request for model that the proxy rejected for the client, with a
+// reason such as budget, requests or tokens.
+func (c *Client) RecordRejection(client, model, reason string) {
+	c.rejectedRequests.WithLabelValues(c.labels.client(client), c.labels.requestedModel(model), reason).Inc()
+}
+
+// SetBudgetRemaining sets the tokens the client has left of its budget for the period, e.g.
+// day or month. A negative remaining means the period has no limit and removes the gauge.
+func (c *Client) SetBudgetRemaining(client, period string, remaining int64) {
+	client = c.labels.client(client)
+	if remaining < 0 {
+		c.budgetRemaining.DeleteLabelValues(client, period)
+		return
+	}
+	c.budgetRemaining.WithLabelValues(client, period).Set(float64(remaining))
+}
+
+// SetCircuitState sets the state of the upstream's circuit breaker, 0 when it is closed, 1 when
+// it is half open and 2 when it is open.
+func (c *Client) SetCircuitState(upstream string, state int) {
+	c.circuitState.WithLabelValues(upstream).Set(float64(state))
+}
+
+// RecordRetry counts a request sent to the upstream again, with a reason such as error or
+// status, or failover when it was sent there after another upstream failed.
+func (c *Client) RecordRetry(upstream, reason string) {
+	c.upstreamRetries.WithLabelValues(upstream, reason).Inc()
+}
+
+// Handler returns the http.Handler that serves the client's Prometheus metrics, e.g. on /metrics.
+func (c *Client) Handler() http.Handler {
+	return c.handler
+}
+
+func metricsHandler(gatherer prometheus.Gatherer) http.Handler {
+	if gatherer == nil {
+		return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			http.Error(w, "metrics registerer has no gatherer", http.StatusInternalServerError)
+		})
+	}
+	return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+}
+
 func (c *Client) initExpvarMetrics() {
 	// Initialize base expvar metrics
-	expvar.NewString("service").Set("pedro-ops")
-	expvar.NewString("version").Set("1.0.0")
+	expvarString("service").Set("pedro-ops")
+	expvarString("version").Set("1.0.0")
 }
 
-// RecordMetrics records metrics from a response
-func (c *Client) RecordMetrics(metrics *types.ResponseMetrics) {
+// publishMutex guards publishing expvar variables. expvar panics when a name is published
+// twice, so clients share the variables that already exist.
+var publishMutex sync.Mutex
+
+func expvarString(name string) *expvar.String {
+	publishMutex.Lock()
+	defer publishMutex.Unlock()
+	if v, ok := expvar.Get(name).(*expvar.String); ok {
+		return v
+	}
+	return expvar.NewString(name)
+}
+
+// expvarStatsName is the expvar variable holding the rolling statistics of every model and
+// endpoint.
+const expvarStatsName = "openai"
+
+var (
+	expvarStatsOnce sync.Once
+	expvarStats     *windowedStats
+)
+
+// sharedExpvarStats returns the statistics published as the openai expvar map, publishing
+// them on first use.
+func sharedExpvarStats() *windowedStats {
+	expvarStatsOnce.Do(func() {
+		expvarStats = newWindowedStats()
+		expvar.Publish(expvarStatsName, expvar.Func(expvarStats.snapshot))
+	})
+	return expvarStats
+}
+
+// RecordMetrics records metrics from a response. Responses whose metrics could not be
+// extracted are only counted as requests and parse errors. The model and endpoint labels are
+// normalized and bounded by the client's label limits.
+func (c *Client) RecordMetrics(original *types.ResponseMetrics) {
+	labelled := *original
+	if original.Model == "" && original.ExtractError != nil {
+		// error envelopes name no model, so failed requests are labelled with the requested one.
+		labelled.Model = c.labels.requestedModel(original.RequestedModel)
+	} else {
+		labelled.Model = c.labels.model(original.Model)
+	}
+	labelled.Endpoint = c.labels.endpoint(original.Endpoint)
+	labelled.Client = c.labels.client(original.Client)
+	metrics := &labelled
+
+	if metrics.ExtractError != nil {
+		c.recordExtractError(metrics)
+		return
+	}
+
 	labels := []string{metrics.Model, metrics.Endpoint}
 	status := fmt.Sprintf("%d", metrics.StatusCode)
 
@@ -149,34 +477,66 @@ func (c *Client) RecordMetrics(metrics *types.ResponseMetrics) {
 
 	// Record Prometheus metrics
 	if latency, ok := calculated["api_latency_ms"]; ok {
-		c.apiLatency.WithLabelValues(labels...).Observe(latency)
+		c.apiLatency.WithLabelValues(c.upstreamValues(metrics, labels...)...).Observe(seconds(latency))
 	}
 
 	if ttft, ok := calculated["time_to_first_token_ms"]; ok {
-		c.timeToFirstToken.WithLabelValues(labels...).Observe(ttft)
+		c.timeToFirstToken.WithLabelValues(c.upstreamValues(metrics, labels...)...).Observe(seconds(ttft))
 	}
 
 	if procTime, ok := calculated["prompt_processing_time_ms"]; ok {
-		c.promptProcessing.WithLabelValues(labels...).Observe(procTime)
+		c.promptProcessing.WithLabelValues(labels...).Observe(seconds(procTime))
 	}
 
 	if genTime, ok := calculated["token_generation_time_ms"]; ok {
-		c.tokenGeneration.WithLabelValues(labels...).Observe(genTime)
+		c.tokenGeneration.WithLabelValues(labels...).Observe(seconds(genTime))
 	}
 
 	if tps, ok := calculated["tokens_per_second"]; ok {
-		c.tokensPerSecond.WithLabelValues(labels...).Set(tps)
+		c.tokensPerSecond.WithLabelValues(labels...).Observe(tps)
+		if c.tokensPerSecondSummary != nil {
+			c.tokensPerSecondSummary.WithLabelValues(labels...).Observe(tps)
+		}
+	}
+
+	if len(metrics.InterTokenLatencies) > 0 {
+		itl := c.interTokenLatency.WithLabelValues(labels...)
+		for _, d := range metrics.InterTokenLatencies {
+			itl.Observe(d.Seconds())
+		}
 	}
 
+	// llama.cpp server timings
+	c.recordServerTimings(labels, calculated)
+
 	// Request counter
-	c.requestCounter.WithLabelValues(metrics.Model, metrics.Endpoint, status).Inc()
+	c.requestCounter.WithLabelValues(c.requestValues(metrics, metrics.Model, metrics.Endpoint, status)...).Inc()
+
+	// Finish reasons, embeddings do not have one
+	if metrics.Endpoint != types.EndpointEmbeddings {
+		c.finishReasons.WithLabelValues(metrics.Model, metrics.Endpoint, normalizeFinishReason(metrics.FinishReason)).Inc()
+	}
+
+	c.recordSubstitution(metrics)
 
 	// Token counters
-	if metrics.PromptTokens > 0 {
-		c.tokenCounter.WithLabelValues(metrics.Model, metrics.Endpoint, "prompt").Add(float64(metrics.PromptTokens))
+	c.recordTokens(metrics)
+	if cost, ok := c.pricing.cost(metrics, calculated); ok && cost > 0 {
+		c.cost.WithLabelValues(metrics.Model, metrics.Client).Add(cost)
 	}
-	if metrics.CompletionTokens > 0 {
-		c.tokenCounter.WithLabelValues(metrics.Model, metrics.Endpoint, "completion").Add(float64(metrics.CompletionTokens))
+	if ratio, ok := calculated["prompt_cache_hit_ratio"]; ok {
+		c.cacheHitRatio.WithLabelValues(labels...).Observe(ratio)
+	}
+
+	// Tool calling metrics
+	if metrics.ToolCalls > 0 {
+		c.toolCallsPerResponse.WithLabelValues(labels...).Observe(float64(metrics.ToolCalls))
+		for _, name := range metrics.ToolNames {
+			c.toolCalls.WithLabelValues(metrics.Model, metrics.Endpoint, c.labels.tool(name)).Inc()
+		}
+	}
+	if metrics.FinishReason == "tool_calls" {
+		c.toolCallResponses.WithLabelValues(labels...).Inc()
 	}
 
 	// Size metrics
@@ -191,39 +551,145 @@ func (c *Client) RecordMetrics(metrics *types.ResponseMetrics) {
 	c.recordExpvarMetrics(metrics, calculated)
 }
 
-func (c *Client) recordExpvarMetrics(metrics *types.ResponseMetrics, calculated map[string]float64) {
-	c.expvarMutex.Lock()
-	defer c.expvarMutex.Unlock()
+// recordExtractError counts a response that metrics could not be extracted from without
+// observing its zero valued latencies and token counts. Failed requests are counted as
+// errors by type, anything else is counted as a parse error.
+func (c *Client) recordExtractError(metrics *types.ResponseMetrics) {
+	model := metrics.Model
+	status := fmt.Sprintf("%d", metrics.StatusCode)
 
-	key := fmt.Sprintf("%s_%s", metrics.Model, metrics.Endpoint)
+	c.requestCounter.WithLabelValues(c.requestValues(metrics, model, metrics.Endpoint, status)...).Inc()
+	reason := middleware.ExtractErrorReason(metrics.ExtractError)
+	if reason == middleware.ReasonAPIError || metrics.StatusCode >= 400 {
+		errorType := metrics.ErrorType
+		if errorType == "" {
+			errorType = "unknown"
+		}
+		c.apiErrors.WithLabelValues(c.upstreamValues(metrics, model, metrics.Endpoint, status, errorType)...).Inc()
+	} else {
+		c.parseErrors.WithLabelValues(metrics.Endpoint, reason).Inc()
+	}
+
+	c.expvarStats.record(time.Now(), model, metrics.Endpoint, true, nil)
+}
 
-	// Request counts
-	if _, exists := c.requestCounts[key]; !exists {
-		c.requestCounts[key] = expvar.NewInt(fmt.Sprintf("requests_%s", key))
+// recordSubstitution counts responses served by a different model than the client requested.
+func (c *Client) recordSubstitution(metrics *types.ResponseMetrics) {
+	if metrics.RequestedModel == "" {
+		return
 	}
-	c.requestCounts[key].Add(1)
+	if requested := c.labels.requestedModel(metrics.RequestedModel); requested != metrics.Model {
+		c.substitutions.WithLabelValues(requested, metrics.Model, metrics.Endpoint).Inc()
+	}
+}
 
-	// Error counts
-	if metrics.StatusCode >= 400 {
-		if _, exists := c.errorCounts[key]; !exists {
-			c.errorCounts[key] = expvar.NewInt(fmt.Sprintf("errors_%s", key))
+// recordServerTimings records the server reported inference timings when they are present.
+func (c *Client) recordServerTimings(labels []string, calculated map[string]float64) {
+	timings := []struct {
+		name      string
+		histogram *prometheus.HistogramVec
+		// scale converts the calculated value to the unit of the histogram.
+		scale float64
+	}{
+		{"server_prompt_processing_time_ms", c.serverPromptProcessing, 1 / msPerSecond},
+		{"server_token_generation_time_ms", c.serverTokenGeneration, 1 / msPerSecond},
+		{"server_prompt_tokens_per_second", c.serverPromptSpeed, 1},
+		{"server_tokens_per_second", c.serverGenerationSpeed, 1},
+		{"network_overhead_ms", c.networkOverhead, 1 / msPerSecond},
+	}
+	for _, t := range timings {
+		if v, ok := calculated[t.name]; ok {
+			t.histogram.WithLabelValues(labels...).Observe(v * t.scale)
 		}
-		c.errorCounts[key].Add(1)
 	}
+}
 
-	// Average latency
-	if latency, ok := calculated["api_latency_ms"]; ok {
-		if _, exists := c.avgLatency[key]; !exists {
-			c.avgLatency[key] = expvar.NewFloat(fmt.Sprintf("avg_latency_%s", key))
+// recordTokens records the prompt and completion tokens, and the cached, reasoning and
+// prediction token details as additional types on the token counter.
+func (c *Client) recordTokens(metrics *types.ResponseMetrics) {
+	details := []struct {
+		tokenType string
+		count     int
+	}{
+		{"prompt", metrics.PromptTokens},
+		{"completion", metrics.CompletionTokens},
+		{"cached", metrics.CachedTokens},
+		{"reasoning", metrics.ReasoningTokens},
+		{"accepted_prediction", metrics.AcceptedPredictionTokens},
+		{"rejected_prediction", metrics.RejectedPredictionTokens},
+	}
+	for _, d := range details {
+		if d.count > 0 {
+			values := c.clientValues(metrics, metrics.Model, metrics.Endpoint, d.tokenType)
+			c.tokenCounter.WithLabelValues(values...).Add(float64(d.count))
 		}
-		c.avgLatency[key].Set(latency)
 	}
+}
 
-	// Average TTFT
-	if ttft, ok := calculated["time_to_first_token_ms"]; ok {
-		if _, exists := c.avgTTFT[key]; !exists {
-			c.avgTTFT[key] = expvar.NewFloat(fmt.Sprintf("avg_ttft_%s", key))
-		}
-		c.avgTTFT[key].Set(ttft)
+// withClientLabel returns the label names followed by client when the client label is enabled.
+func (c *Client) withClientLabel(names ...string) []string {
+	if c.clientLabel {
+		return append(names[:len(names):len(names)], "client")
 	}
+	return names
+}
+
+// clientValues returns the label values followed by the client of metrics when the client
+// label is enabled.
+func (c *Client) clientValues(metrics *types.ResponseMetrics, values ...string) []string {
+	if c.clientLabel {
+		return append(values[:len(values):len(values)], metrics.Client)
+	}
+	return values
+}
+
+// withUpstreamLabel returns the label names followed by upstream when the upstream label is
+// enabled.
+func (c *Client) withUpstreamLabel(names ...string) []string {
+	if c.upstreamLabel {
+		return append(names[:len(names):len(names)], "upstream")
+	}
+	return names
+}
+
+// upstreamValues returns the label values followed by the upstream of metrics when the
+// upstream label is enabled.
+func (c *Client) upstreamValues(metrics *types.ResponseMetrics, values ...string) []string {
+	if c.upstreamLabel {
+		return append(values[:len(values):len(values)], metrics.Upstream)
+	}
+	return values
+}
+
+// withRequestLabels returns the label names followed by the names configured with
+// WithRequestLabels.
+func (c *Client) withRequestLabels(names ...string) []string {
+	return append(names[:len(names):len(names)], c.requestLabels...)
+}
+
+// requestValues returns the values of the request counter labels.
+func (c *Client) requestValues(metrics *types.ResponseMetrics, values ...string) []string {
+	values = c.upstreamValues(metrics, c.clientValues(metrics, values...)...)
+	for _, name := range c.requestLabels {
+		values = append(values, c.labels.requestLabel(name, metrics.Labels[name]))
+	}
+	return values
+}
+
+// normalizeFinishReason maps the finish reason reported by the server onto a fixed set of
+// label values so unexpected values cannot create new series.
+func normalizeFinishReason(reason string) string {
+	switch reason {
+	case "stop", "length", "tool_calls", "content_filter":
+		return reason
+	case "function_call": // deprecated name for tool_calls
+		return "tool_calls"
+	default:
+		return "unknown"
+	}
+}
+
+func (c *Client) recordExpvarMetrics(metrics *types.ResponseMetrics, calculated map[string]float64) {
+	failed := metrics.StatusCode >= 400 || metrics.ExtractError != nil
+	c.expvarStats.record(time.Now(), metrics.Model, metrics.Endpoint, failed, calculated)
 }
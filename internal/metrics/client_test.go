@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/soypete/pedro-ops/internal/middleware"
+	"github.com/soypete/pedro-ops/types"
+)
+
+func TestRecordMetricsErrorModel(t *testing.T) {
+	tests := []struct {
+		name      string
+		model     string
+		requested string
+		want      string
+	}{
+		{"error envelope", "", "gpt-oss-20b", "gpt-oss-20b"},
+		{"error envelope without a requested model", "", "", unknownModel},
+		{"served model", "gpt-oss-120b", "gpt-oss-20b", "gpt-oss-120b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClient()
+			c.RecordMetrics(&types.ResponseMetrics{
+				Model:          tt.model,
+				RequestedModel: tt.requested,
+				Endpoint:       types.EndpointChatCompletions,
+				StatusCode:     503,
+				ErrorType:      "server_error",
+				ExtractError: &middleware.APIError{
+					Endpoint: types.EndpointChatCompletions,
+					Detail:   types.ErrorDetail{Type: "server_error", Message: "loading model"},
+				},
+			})
+			requests := c.requestCounter.WithLabelValues(tt.want, types.EndpointChatCompletions, "503")
+			if got := testutil.ToFloat64(requests); got != 1 {
+				t.Errorf("requests of model %q = %v, want 1", tt.want, got)
+			}
+			errs := c.apiErrors.WithLabelValues(tt.want, types.EndpointChatCompletions, "503", "server_error")
+			if got := testutil.ToFloat64(errs); got != 1 {
+				t.Errorf("errors of model %q = %v, want 1", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNewClientTwice(t *testing.T) {
+	// each client owns a registry, so creating a second one must not panic on duplicate
+	// registration or share counters with the first.
+	first, second := NewClient(), NewClient()
+	first.RecordMetrics(&types.ResponseMetrics{
+		Model: "gpt-oss-20b", Endpoint: types.EndpointChatCompletions, StatusCode: 200,
+	})
+	counter := second.requestCounter.WithLabelValues("gpt-oss-20b", types.EndpointChatCompletions, "200")
+	if got := testutil.ToFloat64(counter); got != 0 {
+		t.Errorf("second client counted %v requests of the first", got)
+	}
+}
+
+func TestNewClientPrefixAndConstLabels(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	c := NewClient(WithRegisterer(reg), WithNamespace("pedro"), WithSubsystem("proxy"),
+		WithConstLabels(prometheus.Labels{"cluster": "home"}))
+	c.RecordMetrics(&types.ResponseMetrics{
+		Model: "gpt-oss-20b", Endpoint: types.EndpointChatCompletions, StatusCode: 200,
+	})
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	var found bool
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), "pedro_proxy_openai_") {
+			t.Errorf("metric %s lacks the pedro_proxy_ prefix", family.GetName())
+		}
+		for _, metric := range family.GetMetric() {
+			var cluster string
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "cluster" {
+					cluster = label.GetValue()
+				}
+			}
+			if cluster != "home" {
+				t.Errorf("metric %s has cluster %q, want home", family.GetName(), cluster)
+			}
+		}
+		found = found || family.GetName() == "pedro_proxy_openai_requests_total"
+	}
+	if !found {
+		t.Error("pedro_proxy_openai_requests_total was not registered")
+	}
+
+	// the handler serves the registry the metrics were registered with.
+	w := httptest.NewRecorder()
+	c.Handler().ServeHTTP(w, httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/metrics", nil))
+	body, err := io.ReadAll(w.Body)
+	if err != nil {
+		t.Fatalf("read metrics: %v", err)
+	}
+	if !strings.Contains(string(body), `pedro_proxy_openai_requests_total{cluster="home"`) {
+		t.Errorf("metrics page lacks the prefixed request counter:\n%s", body)
+	}
+}
@@ -0,0 +1,219 @@
+package metrics
+
+import (
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/soypete/pedro-ops/internal/middleware"
+	"github.com/soypete/pedro-ops/types"
+)
+
+const (
+	// otherLabel is the label value used once a label has too many distinct values or a
+	// value is not allowed.
+	otherLabel = "other"
+	// defaultMaxModels is the number of distinct model labels kept before new models are
+	// recorded as other.
+	defaultMaxModels = 20
+	// defaultMaxClients is the number of distinct client labels kept before new clients are
+	// recorded as other.
+	defaultMaxClients = 20
+	// maxRequestLabelValues is the number of distinct values of each request label kept
+	// before new values are recorded as other.
+	maxRequestLabelValues = 20
+	// defaultMaxTools is the number of distinct tool labels kept before new tools are recorded
+	// as other.
+	defaultMaxTools = 20
+)
+
+var (
+	// shardSuffix matches the split file suffix of sharded gguf models, e.g. -00001-of-00003.
+	shardSuffix = regexp.MustCompile(`-\d{5}-of-\d{5}$`)
+	// quantSuffix matches llama.cpp quantization suffixes, e.g. -Q4_K_M, .Q8_0, -UD-IQ2_XXS, -BF16.
+	quantSuffix = regexp.MustCompile(`(?i)[-._](?:UD-)?(?:I?Q\d+(?:_[A-Z0-9]+)*|F16|BF16|F32)$`)
+)
+
+// NormalizeModel reduces the model reported by a server to a stable name. llama.cpp reports
+// the path of the gguf file, so the directory, extension, shard and quantization suffixes are
+// removed: /opt/models/cache/gpt-oss-20b-Q4_K_M.gguf becomes gpt-oss-20b.
+func NormalizeModel(model string) string {
+	model = path.Base(strings.ReplaceAll(model, "\\", "/"))
+	model = strings.TrimSuffix(model, ".gguf")
+	model = shardSuffix.ReplaceAllString(model, "")
+	model = quantSuffix.ReplaceAllString(model, "")
+	return model
+}
+
+// labelLimiter bounds the values of the model, endpoint, client and tool labels so that
+// upstream or client supplied values cannot create unbounded series.
+type labelLimiter struct {
+	aliases    map[string]string
+	allowlist  map[string]bool
+	maxModels  int
+	maxClients int
+	maxTools   int
+	dropped    *prometheus.CounterVec
+
+	mu     sync.Mutex
+	models map[string]struct{}
+	// requested holds the models named by clients that were never served, bounded apart from
+	// models so made up names cannot crowd out the models that are actually loaded.
+	requested map[string]struct{}
+	clients   map[string]struct{}
+	tools     map[string]struct{}
+	// requestLabels holds the values seen of each label configured with WithRequestLabels.
+	requestLabels map[string]map[string]struct{}
+}
+
+// labelConfig holds the label settings configured with ClientOptions.
+type labelConfig struct {
+	aliases    map[string]string
+	allowlist  []string
+	maxModels  int
+	client     bool
+	maxClients int
+	maxTools   int
+	upstream   bool
+	// requestLabels are the names of the labels recorded from ResponseMetrics.Labels.
+	requestLabels []string
+}
+
+func (c *Client) newLabelLimiter(cfg labelConfig) *labelLimiter {
+	l := &labelLimiter{
+		aliases:       cfg.aliases,
+		maxModels:     cfg.maxModels,
+		maxClients:    cfg.maxClients,
+		maxTools:      cfg.maxTools,
+		models:        make(map[string]struct{}),
+		requested:     make(map[string]struct{}),
+		clients:       make(map[string]struct{}),
+		tools:         make(map[string]struct{}),
+		requestLabels: make(map[string]map[string]struct{}, len(cfg.requestLabels)),
+		dropped: c.factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "openai_label_values_dropped_total",
+				Help: "Total number of label values replaced with other by the cardinality limiter",
+			},
+			[]string{"label"},
+		),
+	}
+	if l.maxModels <= 0 {
+		l.maxModels = defaultMaxModels
+	}
+	if l.maxClients <= 0 {
+		l.maxClients = defaultMaxClients
+	}
+	if l.maxTools <= 0 {
+		l.maxTools = defaultMaxTools
+	}
+	for _, name := range cfg.requestLabels {
+		l.requestLabels[name] = make(map[string]struct{})
+	}
+	if len(cfg.allowlist) > 0 {
+		l.allowlist = make(map[string]bool, len(cfg.allowlist))
+		for _, m := range cfg.allowlist {
+			l.allowlist[m] = true
+		}
+	}
+	return l
+}
+
+// model returns the label value for the model reported in a response.
+func (l *labelLimiter) model(model string) string {
+	model, ok := l.canonicalModel("model", model)
+	if !ok {
+		return model
+	}
+	return l.bound("model", model, l.models, l.maxModels)
+}
+
+// requestedModel returns the label value for a model named in a request. Models that have been
+// served keep their label, other names are bounded in a set of their own.
+func (l *labelLimiter) requestedModel(model string) string {
+	model, ok := l.canonicalModel("requested_model", model)
+	if !ok {
+		return model
+	}
+	l.mu.Lock()
+	_, served := l.models[model]
+	l.mu.Unlock()
+	if served {
+		return model
+	}
+	return l.bound("requested_model", model, l.requested, l.maxModels)
+}
+
+// canonicalModel resolves the aliases of model and normalizes it. It returns false with the
+// final label value when the model is empty or not allowed.
+func (l *labelLimiter) canonicalModel(label, model string) (string, bool) {
+	if model == "" {
+		return unknownModel, false
+	}
+	if alias, ok := l.aliases[model]; ok {
+		return alias, false
+	}
+	model = NormalizeModel(model)
+	if alias, ok := l.aliases[model]; ok {
+		model = alias
+	}
+	if l.allowlist != nil && !l.allowlist[model] {
+		l.dropped.WithLabelValues(label).Inc()
+		return otherLabel, false
+	}
+	return model, true
+}
+
+// client returns the label value for the client a request is attributed to.
+func (l *labelLimiter) client(client string) string {
+	if client == "" {
+		return middleware.AnonymousClient
+	}
+	return l.bound("client", client, l.clients, l.maxClients)
+}
+
+// tool returns the label value for the name of a function the model called. The names come
+// from model output and client defined tools, so they are bounded like clients.
+func (l *labelLimiter) tool(name string) string {
+	if name == "" {
+		return unknownModel
+	}
+	return l.bound("tool", name, l.tools, l.maxTools)
+}
+
+// requestLabel returns the label value for a caller supplied request label.
+func (l *labelLimiter) requestLabel(name, value string) string {
+	if value == "" {
+		return value
+	}
+	return l.bound(name, value, l.requestLabels[name], maxRequestLabelValues)
+}
+
+// bound returns value if it has been seen before or fewer than limit values have been seen,
+// and otherwise counts it as dropped and returns other.
+func (l *labelLimiter) bound(label, value string, seen map[string]struct{}, limit int) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := seen[value]; !ok {
+		if len(seen) >= limit {
+			l.dropped.WithLabelValues(label).Inc()
+			return otherLabel
+		}
+		seen[value] = struct{}{}
+	}
+	return value
+}
+
+// endpoint returns the label value for the endpoint, which must be one of the known endpoints.
+func (l *labelLimiter) endpoint(endpoint string) string {
+	switch endpoint {
+	case types.EndpointChatCompletions, types.EndpointCompletions, types.EndpointEmbeddings:
+		return endpoint
+	default:
+		l.dropped.WithLabelValues("endpoint").Inc()
+		return otherLabel
+	}
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/soypete/pedro-ops/types"
+)
+
+func TestNormalizeModel(t *testing.T) {
+	tests := []struct {
+		model string
+		want  string
+	}{
+		{"/opt/models/cache/gpt-oss-20b-Q4_K_M.gguf", "gpt-oss-20b"},
+		{"gpt-oss-120b-mxfp4-00001-of-00003.gguf", "gpt-oss-120b-mxfp4"},
+		{"Qwen3-Coder-30B-A3B-Instruct-UD-IQ2_XXS.gguf", "Qwen3-Coder-30B-A3B-Instruct"},
+		{"llama-3.1-8b-instruct.Q8_0.gguf", "llama-3.1-8b-instruct"},
+		{"gemma-3-27b-it-BF16", "gemma-3-27b-it"},
+		{`C:\models\phi-4-f16.gguf`, "phi-4"},
+		{"gpt-4o", "gpt-4o"},
+		{"gpt-4o-2024-08-06", "gpt-4o-2024-08-06"},
+		{"Qwen2.5-7B", "Qwen2.5-7B"},
+	}
+	for _, tt := range tests {
+		if got := NormalizeModel(tt.model); got != tt.want {
+			t.Errorf("NormalizeModel(%q) = %q, want %q", tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestRequestedModelsDoNotCrowdOutServedModels(t *testing.T) {
+	l := NewClient(WithMaxModels(2)).labels
+	if got := l.model("gpt-oss-20b"); got != "gpt-oss-20b" {
+		t.Fatalf("model(gpt-oss-20b) = %q", got)
+	}
+	for _, name := range []string{"junk-1", "junk-2", "junk-3"} {
+		l.requestedModel(name)
+	}
+
+	tests := []struct {
+		name  string
+		label func(string) string
+		model string
+		want  string
+	}{
+		{"served model requested", l.requestedModel, "gpt-oss-20b", "gpt-oss-20b"},
+		{"requested model over the bound", l.requestedModel, "junk-4", otherLabel},
+		{"requested model seen before", l.requestedModel, "junk-1", "junk-1"},
+		{"model loaded later", l.model, "Qwen3-8B-Q4_K_M.gguf", "Qwen3-8B"},
+		{"model over the bound", l.model, "gemma-3", otherLabel},
+	}
+	for _, tt := range tests {
+		if got := tt.label(tt.model); got != tt.want {
+			t.Errorf("%s: label of %q = %q, want %q", tt.name, tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestToolLabelsAreBounded(t *testing.T) {
+	l := NewClient(WithMaxTools(2)).labels
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"get_weather", "get_weather"},
+		{"search", "search"},
+		{"made_up_by_the_model", otherLabel},
+		{"get_weather", "get_weather"},
+		{"", unknownModel},
+	}
+	for _, tt := range tests {
+		if got := l.tool(tt.name); got != tt.want {
+			t.Errorf("tool(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRequestLabels(t *testing.T) {
+	c := NewClient(WithRequestLabels("team"))
+	record := func(labels map[string]string) {
+		c.RecordMetrics(&types.ResponseMetrics{
+			Model:      "gpt-oss-20b",
+			Endpoint:   types.EndpointChatCompletions,
+			StatusCode: 200,
+			Labels:     labels,
+		})
+	}
+	record(map[string]string{"team": "analytics", "ignored": "x"})
+	record(map[string]string{"team": "analytics"})
+	record(nil)
+
+	tests := []struct {
+		team string
+		want float64
+	}{
+		{"analytics", 2},
+		{"", 1},
+	}
+	for _, tt := range tests {
+		counter := c.requestCounter.WithLabelValues("gpt-oss-20b", types.EndpointChatCompletions, "200", tt.team)
+		if got := testutil.ToFloat64(counter); got != tt.want {
+			t.Errorf("requests of team %q = %v, want %v", tt.team, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package metrics
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ClientOption configures a Client.
+type ClientOption func(*clientConfig)
+
+type clientConfig struct {
+	registerer  prometheus.Registerer
+	gatherer    prometheus.Gatherer
+	namespace   string
+	subsystem   string
+	constLabels prometheus.Labels
+	histograms  histogramConfig
+	labels      labelConfig
+	pricing     Pricing
+}
+
+// WithRegisterer registers the Prometheus metrics with reg instead of a new registry owned by
+// the client. If reg is also a prometheus.Gatherer, such as a *prometheus.Registry, Handler
+// serves it; otherwise use WithGatherer as well.
+func WithRegisterer(reg prometheus.Registerer) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.registerer = reg
+		if g, ok := reg.(prometheus.Gatherer); ok {
+			cfg.gatherer = g
+		} else if reg == prometheus.DefaultRegisterer {
+			cfg.gatherer = prometheus.DefaultGatherer
+		}
+	}
+}
+
+// WithGatherer sets the gatherer Handler serves metrics from.
+func WithGatherer(g prometheus.Gatherer) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.gatherer = g
+	}
+}
+
+// WithNamespace prefixes every metric name with namespace, e.g. "pedro" registers
+// pedro_openai_requests_total.
+func WithNamespace(namespace string) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.namespace = namespace
+	}
+}
+
+// WithSubsystem prefixes every metric name with subsystem, after the namespace.
+func WithSubsystem(subsystem string) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.subsystem = subsystem
+	}
+}
+
+// WithConstLabels adds labels with fixed values to every metric, e.g. the cluster or
+// instance the client runs in.
+func WithConstLabels(labels prometheus.Labels) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.constLabels = labels
+	}
+}
+
+// WithBuckets overrides the buckets of the histogram with the given name, without any
+// namespace or subsystem prefix, e.g. "openai_api_latency_seconds".
+func WithBuckets(name string, buckets []float64) ClientOption {
+	return func(cfg *clientConfig) {
+		if cfg.histograms.buckets == nil {
+			cfg.histograms.buckets = make(map[string][]float64)
+		}
+		cfg.histograms.buckets[name] = buckets
+	}
+}
+
+// WithNativeHistograms additionally exposes every histogram as a Prometheus native histogram
+// with the given bucket growth factor, e.g. 1.1. The classic buckets are kept for scrapers
+// that do not support native histograms.
+func WithNativeHistograms(bucketFactor float64) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.histograms.nativeBucketFactor = bucketFactor
+	}
+}
+
+// WithThroughputSummary additionally exports tokens per second as a summary with p50, p95
+// and p99 quantiles. Summaries cannot be aggregated across instances, so prefer the histogram
+// unless a single proxy serves all traffic.
+func WithThroughputSummary() ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.histograms.throughputSummary = true
+	}
+}
+
+// WithModelAliases maps model names to the label value recorded for them. Keys are matched
+// against both the reported and the normalized model name, e.g.
+// {"Qwen3-Coder-30B-A3B-Instruct": "qwen3-coder"}.
+func WithModelAliases(aliases map[string]string) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.labels.aliases = aliases
+	}
+}
+
+// WithModelAllowlist records only the given normalized or aliased model names, anything else
+// is recorded as other.
+func WithModelAllowlist(models []string) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.labels.allowlist = models
+	}
+}
+
+// WithMaxModels sets the number of distinct model labels recorded before new models are
+// recorded as other. It defaults to 20.
+func WithMaxModels(n int) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.labels.maxModels = n
+	}
+}
+
+// WithMaxTools sets the number of distinct tool labels of openai_tool_calls_total recorded
+// before new tools are recorded as other. It defaults to 20.
+func WithMaxTools(n int) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.labels.maxTools = n
+	}
+}
+
+// WithClientLabel adds a client label to openai_requests_total and openai_tokens_total with
+// the client each request is attributed to. At most maxClients distinct clients are recorded,
+// further clients are recorded as other; 0 uses the default of 20.
+func WithClientLabel(maxClients int) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.labels.client = true
+		cfg.labels.maxClients = maxClients
+	}
+}
+
+// WithRequestLabels adds a label to openai_requests_total for each of the names, set to the
+// value the request's ResponseMetrics.Labels has for it, e.g. set with the calculator's
+// WithLabels option. Requests without the label record it empty. At most 20 distinct values
+// are recorded per label, further values are recorded as other. The names must be valid
+// Prometheus label names other than the labels the counter already has.
+func WithRequestLabels(names ...string) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.labels.requestLabels = append(cfg.labels.requestLabels, names...)
+	}
+}
+
+// WithPricing records the cost of every response priced in pricing as
+// openai_cost_dollars_total.
+func WithPricing(pricing Pricing) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.pricing = pricing
+	}
+}
+
+// WithUpstreamLabel adds an upstream label to openai_requests_total, openai_errors_total,
+// openai_api_latency_seconds and openai_time_to_first_token_seconds with the name of the
+// upstream a proxy routed each request to.
+func WithUpstreamLabel() ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.labels.upstream = true
+	}
+}
+
+func newClientConfig(opts []ClientOption) clientConfig {
+	var cfg clientConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.registerer == nil {
+		registry := prometheus.NewRegistry()
+		cfg.registerer = registry
+		cfg.gatherer = registry
+	}
+	return cfg
+}
+
+// wrappedRegisterer returns the registerer that applies the prefix and const labels.
+func (cfg *clientConfig) wrappedRegisterer() prometheus.Registerer {
+	reg := cfg.registerer
+	if len(cfg.constLabels) > 0 {
+		reg = prometheus.WrapRegistererWith(cfg.constLabels, reg)
+	}
+	var parts []string
+	for _, p := range []string{cfg.namespace, cfg.subsystem} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	if len(parts) > 0 {
+		reg = prometheus.WrapRegistererWithPrefix(strings.Join(parts, "_")+"_", reg)
+	}
+	return reg
+}
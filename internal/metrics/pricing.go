@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/soypete/pedro-ops/types"
+)
+
+const (
+	// tokensPerPrice is the number of tokens prices are quoted for.
+	tokensPerPrice = 1e6
+	// defaultPrice is the pricing table entry used for models without their own.
+	defaultPrice = "default"
+)
+
+// Pricing maps model labels, i.e. normalized or aliased model names, to their price. The
+// default entry prices models without their own entry.
+type Pricing map[string]ModelPrice
+
+// ModelPrice is the cost of a model. Token prices are in dollars per million tokens; Local
+// adds the cost of running the model on our own hardware.
+type ModelPrice struct {
+	Input float64 `json:"input"`
+	// CachedInput is the price of prompt tokens served from the prompt cache, 0 uses Input.
+	CachedInput float64 `json:"cached_input"`
+	Output      float64 `json:"output"`
+	// Reasoning is the price of reasoning tokens, 0 uses Output.
+	Reasoning float64    `json:"reasoning"`
+	Local     *LocalCost `json:"local,omitempty"`
+}
+
+// LocalCost is the amortized cost of a local GPU per hour of inference: the electricity it
+// draws plus the hardware cost spread over its lifetime. Concurrent requests are each charged
+// for their full duration, so the cost of batched inference is overestimated.
+type LocalCost struct {
+	Watts                  float64 `json:"watts"`
+	DollarsPerKWh          float64 `json:"dollars_per_kwh"`
+	HardwareDollarsPerHour float64 `json:"hardware_dollars_per_hour"`
+}
+
+// LoadPricing reads a json pricing table, e.g.
+//
+//	{
+//	  "gpt-4o": {"input": 2.5, "cached_input": 1.25, "output": 10},
+//	  "default": {"local": {"watts": 350, "dollars_per_kwh": 0.15, "hardware_dollars_per_hour": 0.25}}
+//	}
+func LoadPricing(path string) (Pricing, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read pricing: %w", err)
+	}
+	var pricing Pricing
+	if err := json.Unmarshal(data, &pricing); err != nil {
+		return nil, fmt.Errorf("decode pricing %s: %w", path, err)
+	}
+	return pricing, nil
+}
+
+// cost returns the dollar cost of the response, and false when the model has no price.
+func (p Pricing) cost(metrics *types.ResponseMetrics, calculated map[string]float64) (float64, bool) {
+	price, ok := p[metrics.Model]
+	if !ok {
+		price, ok = p[defaultPrice]
+	}
+	if !ok {
+		return 0, false
+	}
+
+	cachedPrice := price.CachedInput
+	if cachedPrice == 0 {
+		cachedPrice = price.Input
+	}
+	reasoningPrice := price.Reasoning
+	if reasoningPrice == 0 {
+		reasoningPrice = price.Output
+	}
+	cost := (float64(metrics.PromptTokens-metrics.CachedTokens)*price.Input +
+		float64(metrics.CachedTokens)*cachedPrice +
+		float64(metrics.CompletionTokens-metrics.ReasoningTokens)*price.Output +
+		float64(metrics.ReasoningTokens)*reasoningPrice) / tokensPerPrice
+
+	if price.Local != nil {
+		cost += price.Local.cost(inferenceSeconds(calculated))
+	}
+	return cost, true
+}
+
+// cost returns the cost of seconds of inference.
+func (l *LocalCost) cost(seconds float64) float64 {
+	perHour := l.Watts/1000*l.DollarsPerKWh + l.HardwareDollarsPerHour
+	return perHour * seconds / 3600
+}
+
+// inferenceSeconds returns the time the server spent on the request, preferring the timings
+// llama.cpp reports over the api latency.
+func inferenceSeconds(calculated map[string]float64) float64 {
+	prompt, okPrompt := calculated["server_prompt_processing_time_ms"]
+	generation, okGeneration := calculated["server_token_generation_time_ms"]
+	if okPrompt || okGeneration {
+		return seconds(prompt + generation)
+	}
+	return seconds(calculated["api_latency_ms"])
+}
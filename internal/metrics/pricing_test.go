@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/soypete/pedro-ops/types"
+)
+
+func TestPricingCost(t *testing.T) {
+	pricing := Pricing{
+		"gpt-4o":    {Input: 2, CachedInput: 1, Output: 10},
+		"o3":        {Input: 2, Output: 8, Reasoning: 20},
+		"flat":      {Input: 4, Output: 4},
+		"local-gpu": {Local: &LocalCost{Watts: 500, DollarsPerKWh: 0.2, HardwareDollarsPerHour: 0.9}},
+	}
+	// a million tokens of each kind makes the costs read as the per million prices.
+	const m = 1_000_000
+	tests := []struct {
+		name       string
+		pricing    Pricing
+		metrics    types.ResponseMetrics
+		calculated map[string]float64
+		want       float64
+		priced     bool
+	}{
+		{
+			name:    "cached prompt tokens",
+			pricing: pricing,
+			metrics: types.ResponseMetrics{Model: "gpt-4o", PromptTokens: 3 * m, CachedTokens: m, CompletionTokens: m},
+			want:    2*2 + 1 + 10,
+			priced:  true,
+		},
+		{
+			name:    "reasoning tokens",
+			pricing: pricing,
+			metrics: types.ResponseMetrics{Model: "o3", PromptTokens: m, CompletionTokens: 3 * m, ReasoningTokens: m},
+			want:    2 + 2*8 + 20,
+			priced:  true,
+		},
+		{
+			name:    "cached and reasoning tokens at the base prices",
+			pricing: pricing,
+			metrics: types.ResponseMetrics{
+				Model: "flat", PromptTokens: 2 * m, CachedTokens: m, CompletionTokens: 2 * m, ReasoningTokens: m,
+			},
+			want:   16,
+			priced: true,
+		},
+		{
+			name:    "local cost from server timings",
+			pricing: pricing,
+			metrics: types.ResponseMetrics{Model: "local-gpu", PromptTokens: m, CompletionTokens: m},
+			calculated: map[string]float64{
+				"server_prompt_processing_time_ms": 600_000,
+				"server_token_generation_time_ms":  1_200_000,
+				"api_latency_ms":                   7_200_000,
+			},
+			// half an hour of 0.1 $/h electricity and 0.9 $/h hardware.
+			want:   0.5,
+			priced: true,
+		},
+		{
+			name:       "local cost from api latency",
+			pricing:    pricing,
+			metrics:    types.ResponseMetrics{Model: "local-gpu"},
+			calculated: map[string]float64{"api_latency_ms": 7_200_000},
+			want:       2,
+			priced:     true,
+		},
+		{
+			name:    "default price",
+			pricing: Pricing{"default": {Input: 1, Output: 1}},
+			metrics: types.ResponseMetrics{Model: "unpriced", PromptTokens: m, CompletionTokens: m},
+			want:    2,
+			priced:  true,
+		},
+		{
+			name:    "no price",
+			pricing: pricing,
+			metrics: types.ResponseMetrics{Model: "unpriced", PromptTokens: m},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, priced := tt.pricing.cost(&tt.metrics, tt.calculated)
+			if priced != tt.priced || math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("cost = %v, %v, want %v, %v", got, priced, tt.want, tt.priced)
+			}
+		})
+	}
+}
+
+func TestLoadPricing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pricing.json")
+	data := `{"gpt-4o": {"input": 2.5, "cached_input": 1.25, "output": 10},
+		"default": {"local": {"watts": 350, "dollars_per_kwh": 0.15, "hardware_dollars_per_hour": 0.25}}}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("write pricing: %v", err)
+	}
+	pricing, err := LoadPricing(path)
+	if err != nil {
+		t.Fatalf("LoadPricing: %v", err)
+	}
+	if got := pricing["gpt-4o"]; got.CachedInput != 1.25 || got.Output != 10 {
+		t.Errorf("gpt-4o price = %+v", got)
+	}
+	if local := pricing[defaultPrice].Local; local == nil || local.Watts != 350 {
+		t.Errorf("default local cost = %+v, want 350 watts", local)
+	}
+}
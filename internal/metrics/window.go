@@ -0,0 +1,203 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// ewmaAlpha is the weight of the newest observation in the moving averages.
+	ewmaAlpha = 0.1
+	// maxWindowSamples bounds the samples kept per statistic so a burst of traffic
+	// cannot grow memory without limit. Percentiles of busier windows are computed
+	// from the most recent samples.
+	maxWindowSamples = 10000
+)
+
+// percentileWindows are the windows percentiles are reported over. The last window is the
+// longest and decides how long samples are kept.
+var percentileWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"15m", 15 * time.Minute},
+}
+
+type sample struct {
+	at    time.Time
+	value float64
+}
+
+// rollingStat keeps an exponentially weighted moving average and the samples of the longest
+// percentile window.
+type rollingStat struct {
+	ewma    float64
+	seen    bool
+	samples []sample
+}
+
+// windowSnapshot are the percentiles of the samples within a window.
+type windowSnapshot struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+}
+
+// statSnapshot is the json view of a rollingStat.
+type statSnapshot struct {
+	EWMA    float64                   `json:"ewma"`
+	Windows map[string]windowSnapshot `json:"windows"`
+}
+
+func (r *rollingStat) observe(now time.Time, value float64) {
+	if r.seen {
+		r.ewma = ewmaAlpha*value + (1-ewmaAlpha)*r.ewma
+	} else {
+		r.ewma = value
+		r.seen = true
+	}
+	r.samples = append(r.samples, sample{at: now, value: value})
+	r.trim(now)
+}
+
+// trim drops samples older than the longest window and beyond maxWindowSamples.
+func (r *rollingStat) trim(now time.Time) {
+	cutoff := now.Add(-percentileWindows[len(percentileWindows)-1].duration)
+	i := sort.Search(len(r.samples), func(i int) bool {
+		return r.samples[i].at.After(cutoff)
+	})
+	if over := len(r.samples) - i - maxWindowSamples; over > 0 {
+		i += over
+	}
+	if i == 0 {
+		return
+	}
+	// copy so the dropped samples do not pin the backing array.
+	r.samples = append([]sample(nil), r.samples[i:]...)
+}
+
+func (r *rollingStat) snapshot(now time.Time) statSnapshot {
+	snap := statSnapshot{
+		EWMA:    r.ewma,
+		Windows: make(map[string]windowSnapshot, len(percentileWindows)),
+	}
+	for _, w := range percentileWindows {
+		cutoff := now.Add(-w.duration)
+		var values []float64
+		for _, s := range r.samples {
+			if s.at.After(cutoff) {
+				values = append(values, s.value)
+			}
+		}
+		sort.Float64s(values)
+		snap.Windows[w.name] = windowSnapshot{
+			Count: len(values),
+			P50:   percentile(values, 0.50),
+			P95:   percentile(values, 0.95),
+			P99:   percentile(values, 0.99),
+		}
+	}
+	return snap
+}
+
+// percentile returns the nearest rank percentile p of the sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// keyStats are the expvar statistics of one model and endpoint.
+type keyStats struct {
+	model           string
+	endpoint        string
+	requests        int64
+	errors          int64
+	latency         rollingStat
+	ttft            rollingStat
+	tokensPerSecond rollingStat
+}
+
+// keySnapshot is the json view of keyStats.
+type keySnapshot struct {
+	Model           string       `json:"model"`
+	Endpoint        string       `json:"endpoint"`
+	Requests        int64        `json:"requests"`
+	Errors          int64        `json:"errors"`
+	LatencyMS       statSnapshot `json:"latency_ms"`
+	TTFTMS          statSnapshot `json:"ttft_ms"`
+	TokensPerSecond statSnapshot `json:"tokens_per_second"`
+}
+
+// windowedStats holds the rolling statistics of every model and endpoint. It is published
+// once as a single expvar map and shared by all clients in the process.
+type windowedStats struct {
+	mu   sync.Mutex
+	keys map[string]*keyStats
+}
+
+func newWindowedStats() *windowedStats {
+	return &windowedStats{keys: make(map[string]*keyStats)}
+}
+
+func (s *windowedStats) record(
+	now time.Time, model, endpoint string, failed bool, calculated map[string]float64,
+) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := model + "/" + endpoint
+	stats, ok := s.keys[key]
+	if !ok {
+		stats = &keyStats{model: model, endpoint: endpoint}
+		s.keys[key] = stats
+	}
+
+	stats.requests++
+	if failed {
+		stats.errors++
+	}
+	if latency, ok := calculated["api_latency_ms"]; ok {
+		stats.latency.observe(now, latency)
+	}
+	if ttft, ok := calculated["time_to_first_token_ms"]; ok {
+		stats.ttft.observe(now, ttft)
+	}
+	if tps, ok := calculated["tokens_per_second"]; ok {
+		stats.tokensPerSecond.observe(now, tps)
+	}
+}
+
+// snapshot returns the statistics keyed by model/endpoint, for use with expvar.Func.
+func (s *windowedStats) snapshot() any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	out := make(map[string]keySnapshot, len(s.keys))
+	for key, stats := range s.keys {
+		stats.latency.trim(now)
+		stats.ttft.trim(now)
+		stats.tokensPerSecond.trim(now)
+		out[key] = keySnapshot{
+			Model:           stats.model,
+			Endpoint:        stats.endpoint,
+			Requests:        stats.requests,
+			Errors:          stats.errors,
+			LatencyMS:       stats.latency.snapshot(now),
+			TTFTMS:          stats.ttft.snapshot(now),
+			TokensPerSecond: stats.tokensPerSecond.snapshot(now),
+		}
+	}
+	return out
+}
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	values := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	tests := []struct {
+		values []float64
+		p      float64
+		want   float64
+	}{
+		{nil, 0.5, 0},
+		{[]float64{7}, 0.99, 7},
+		{values, 0, 1},
+		{values, 0.5, 5},
+		{values, 0.95, 10},
+		{values, 0.11, 2},
+	}
+	for _, tt := range tests {
+		if got := percentile(tt.values, tt.p); got != tt.want {
+			t.Errorf("percentile(%v, %v) = %v, want %v", tt.values, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestRollingStatWindows(t *testing.T) {
+	now := time.Now()
+	var r rollingStat
+	// one sample per minute for the last 20 minutes, the value being its age in minutes.
+	for age := 20; age >= 0; age-- {
+		r.observe(now.Add(-time.Duration(age)*time.Minute), float64(age))
+	}
+	snap := r.snapshot(now)
+
+	tests := []struct {
+		window string
+		count  int
+		p50    float64
+		p99    float64
+	}{
+		{"1m", 1, 0, 0},
+		{"5m", 5, 2, 4},
+		{"15m", 15, 7, 14},
+	}
+	for _, tt := range tests {
+		got := snap.Windows[tt.window]
+		if got.Count != tt.count || got.P50 != tt.p50 || got.P99 != tt.p99 {
+			t.Errorf("window %s = %+v, want count %d p50 %v p99 %v", tt.window, got, tt.count, tt.p50, tt.p99)
+		}
+	}
+	if len(r.samples) != 15 {
+		t.Errorf("kept %d samples, want the 15 within the longest window", len(r.samples))
+	}
+}
+
+func TestRollingStatEWMA(t *testing.T) {
+	now := time.Now()
+	var r rollingStat
+	r.observe(now, 100)
+	r.observe(now, 200)
+	if want := 110.0; math.Abs(r.ewma-want) > 1e-9 {
+		t.Errorf("ewma = %v, want %v", r.ewma, want)
+	}
+}
+
+func TestRollingStatBoundsSamples(t *testing.T) {
+	now := time.Now()
+	var r rollingStat
+	for i := range maxWindowSamples + 10 {
+		r.observe(now, float64(i))
+	}
+	if len(r.samples) != maxWindowSamples {
+		t.Fatalf("kept %d samples, want %d", len(r.samples), maxWindowSamples)
+	}
+	if r.samples[0].value != 10 {
+		t.Errorf("oldest sample = %v, want the oldest ones dropped first", r.samples[0].value)
+	}
+}
+
+func TestWindowedStats(t *testing.T) {
+	s := newWindowedStats()
+	now := time.Now()
+	s.record(now, "gpt-oss-20b", "chat_completions", false, map[string]float64{
+		"api_latency_ms": 200, "time_to_first_token_ms": 50, "tokens_per_second": 40,
+	})
+	s.record(now, "gpt-oss-20b", "chat_completions", true, nil)
+	s.record(now, "gpt-oss-20b", "embeddings", false, map[string]float64{"api_latency_ms": 20})
+
+	snap, ok := s.snapshot().(map[string]keySnapshot)
+	if !ok {
+		t.Fatalf("snapshot is %T", s.snapshot())
+	}
+	chat := snap["gpt-oss-20b/chat_completions"]
+	if chat.Requests != 2 || chat.Errors != 1 {
+		t.Errorf("chat requests %d errors %d, want 2 and 1", chat.Requests, chat.Errors)
+	}
+	if got := chat.LatencyMS.Windows["1m"]; got.Count != 1 || got.P50 != 200 {
+		t.Errorf("chat latency 1m window = %+v, want one sample of 200", got)
+	}
+	if got := chat.TokensPerSecond.EWMA; got != 40 {
+		t.Errorf("chat tokens per second ewma = %v, want 40", got)
+	}
+	if got := snap["gpt-oss-20b/embeddings"].TTFTMS.Windows["15m"].Count; got != 0 {
+		t.Errorf("embeddings ttft samples = %d, want 0", got)
+	}
+}
@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/soypete/pedro-ops/types"
+)
+
+// Reasons returned by ExtractErrorReason, used as the reason label of parse failures.
+const (
+	ReasonUnknownEndpoint = "unknown_endpoint"
+	ReasonMalformed       = "malformed_response"
+	ReasonAPIError        = "api_error"
+)
+
+// UnknownEndpointError is returned when metrics are extracted for an endpoint that is
+// not supported.
+type UnknownEndpointError struct {
+	Endpoint string
+}
+
+func (e *UnknownEndpointError) Error() string {
+	return fmt.Sprintf("unknown endpoint %q", e.Endpoint)
+}
+
+// MalformedResponseError is returned when the response body cannot be parsed as the
+// response of the endpoint.
+type MalformedResponseError struct {
+	Endpoint string
+	Err      error
+}
+
+func (e *MalformedResponseError) Error() string {
+	return fmt.Sprintf("malformed %s response: %v", e.Endpoint, e.Err)
+}
+
+func (e *MalformedResponseError) Unwrap() error {
+	return e.Err
+}
+
+// APIError is returned when the response body is an OpenAI error envelope instead of a
+// result.
+type APIError struct {
+	Endpoint string
+	Detail   types.ErrorDetail
+}
+
+func (e *APIError) Error() string {
+	if e.Detail.Type == "" {
+		return fmt.Sprintf("%s api error: %s", e.Endpoint, e.Detail.Message)
+	}
+	return fmt.Sprintf("%s api error (%s): %s", e.Endpoint, e.Detail.Type, e.Detail.Message)
+}
+
+// setAPIErrorMetrics copies the error type and code of an *APIError into metrics.
+func setAPIErrorMetrics(err error, metrics *types.ResponseMetrics) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		metrics.ErrorType = apiErr.Detail.Type
+		metrics.ErrorCode = string(apiErr.Detail.Code)
+	}
+}
+
+// parseAPIError returns an *APIError if body is an OpenAI error envelope.
+func parseAPIError(body []byte, endpoint string) *APIError {
+	var envelope types.ErrorResponse
+	if err := json.Unmarshal(body, &envelope); err != nil || envelope.Error == nil {
+		return nil
+	}
+	return &APIError{Endpoint: endpoint, Detail: *envelope.Error}
+}
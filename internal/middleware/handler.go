@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/soypete/pedro-ops/types"
+)
+
+// Handler returns http middleware for services that serve OpenAI compatible endpoints
+// themselves. The endpoint is inferred from the request path, the response is teed as it
+// is written, and the metrics are recorded with recorder once next returns. Requests to
+// other paths are passed to next without being recorded.
+func (m *OpenAIMiddleware) Handler(recorder Recorder) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			endpoint := EndpointFromPath(r.URL.Path)
+			if endpoint == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			metrics := &types.ResponseMetrics{
+				RequestStartTime: time.Now(),
+				Endpoint:         endpoint,
+				Client:           m.identifyClient(r),
+			}
+			body := &requestBody{ReadCloser: r.Body}
+			if r.Body != nil {
+				r.Body = body
+			}
+			rw := &responseRecorder{
+				ResponseWriter: w,
+				mw:             m,
+				metrics:        metrics,
+				recorder:       requestRecorder(r.Context(), recorder),
+			}
+
+			next.ServeHTTP(rw, r)
+
+			metrics.RequestSize = int64(body.buf.Len())
+			if r.ContentLength > metrics.RequestSize {
+				metrics.RequestSize = r.ContentLength
+			}
+			m.ExtractRequestMetrics(body.buf.Bytes(), metrics, endpoint)
+			if !rw.wroteHeader {
+				rw.WriteHeader(http.StatusOK)
+			}
+			rw.capture.finish()
+		})
+	}
+}
+
+// requestBody keeps a copy of the bytes the handler reads from the request body, so the
+// request parameters can be extracted once the handler returns.
+type requestBody struct {
+	io.ReadCloser
+	buf bytes.Buffer
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+// responseRecorder is an http.ResponseWriter that tees the response into a
+// responseCapture. It implements http.Flusher so server sent events are still flushed
+// to the client as they are written.
+type responseRecorder struct {
+	http.ResponseWriter
+	mw          *OpenAIMiddleware
+	metrics     *types.ResponseMetrics
+	recorder    Recorder
+	capture     *responseCapture
+	wroteHeader bool
+}
+
+func (rw *responseRecorder) WriteHeader(code int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	rw.metrics.StatusCode = code
+	rw.metrics.ResponseStartTime = time.Now()
+	rw.capture = rw.mw.newResponseCapture(rw.metrics, rw.Header().Get("Content-Type"), rw.recorder)
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseRecorder) Write(p []byte) (int, error) {
+	if !rw.wroteHeader {
+		if rw.Header().Get("Content-Type") == "" {
+			rw.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		rw.WriteHeader(http.StatusOK)
+	}
+	n, err := rw.ResponseWriter.Write(p)
+	rw.capture.write(p[:n])
+	return n, err
+}
+
+// Flush implements http.Flusher.
+func (rw *responseRecorder) Flush() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying http.ResponseWriter for use with http.ResponseController.
+func (rw *responseRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/soypete/pedro-ops/types"
+)
+
+func TestHandler(t *testing.T) {
+	// serveStream writes the events one at a time and flushes each, as an llm server does.
+	serveStream := func(t *testing.T, w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		rc := http.NewResponseController(w)
+		for _, event := range strings.SplitAfter(chatStream, "\n\n") {
+			if _, err := io.WriteString(w, event); err != nil {
+				t.Errorf("write event: %v", err)
+			}
+			if err := rc.Flush(); err != nil {
+				t.Errorf("flush: %v", err)
+			}
+		}
+	}
+	serveJSON := func(t *testing.T, w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := io.WriteString(w, chatResponse); err != nil {
+			t.Errorf("write response: %v", err)
+		}
+	}
+	tests := []struct {
+		name     string
+		serve    func(t *testing.T, w http.ResponseWriter)
+		response string
+		tokens   int
+		flushed  bool
+	}{
+		{"json", serveJSON, chatResponse, 1, false},
+		{"event stream", serveStream, chatStream, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rec recorded
+			handler := NewOpenAIMiddleware().Handler(&rec)(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					if _, err := io.ReadAll(r.Body); err != nil {
+						t.Errorf("read request: %v", err)
+					}
+					tt.serve(t, w)
+				}))
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodPost, "/v1/chat/completions",
+				strings.NewReader(chatRequest))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Body.String() != tt.response {
+				t.Errorf("body = %s, want the handler's response", w.Body)
+			}
+			if w.Flushed != tt.flushed {
+				t.Errorf("flushed = %v, want %v", w.Flushed, tt.flushed)
+			}
+			got := rec.get()
+			if len(got) != 1 {
+				t.Fatalf("recorded %d times, want once", len(got))
+			}
+			m := got[0]
+			if m.ExtractError != nil {
+				t.Errorf("ExtractError = %v", m.ExtractError)
+			}
+			if m.StatusCode != http.StatusOK || m.RequestedModel != "gpt-oss" || m.Model != "gpt-oss-20b" {
+				t.Errorf("status %d model %q requested %q, want 200 gpt-oss-20b gpt-oss",
+					m.StatusCode, m.Model, m.RequestedModel)
+			}
+			if m.CompletionTokens != tt.tokens {
+				t.Errorf("CompletionTokens = %d, want %d", m.CompletionTokens, tt.tokens)
+			}
+			if m.RequestSize != int64(len(chatRequest)) || m.ResponseSize != int64(len(tt.response)) {
+				t.Errorf("sizes = %d and %d, want %d and %d", m.RequestSize, m.ResponseSize,
+					len(chatRequest), len(tt.response))
+			}
+		})
+	}
+}
+
+func TestHandlerWithoutResponse(t *testing.T) {
+	var rec recorded
+	handler := NewOpenAIMiddleware().Handler(&rec)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodPost, "/v1/embeddings",
+		strings.NewReader(`{"model":"nomic-embed","input":"hi"}`))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	got := rec.get()
+	if len(got) != 1 {
+		t.Fatalf("recorded %d times, want once", len(got))
+	}
+	if got[0].StatusCode != http.StatusOK || got[0].Endpoint != types.EndpointEmbeddings {
+		t.Errorf("status %d endpoint %q, want 200 embeddings", got[0].StatusCode, got[0].Endpoint)
+	}
+	// the request body was never read by the handler, so its size comes from ContentLength.
+	if got[0].RequestSize != req.ContentLength {
+		t.Errorf("RequestSize = %d, want %d", got[0].RequestSize, req.ContentLength)
+	}
+}
@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// ClientNameHeader is the header callers set to name themselves.
+	ClientNameHeader = "X-Client-Name"
+	// TailscaleUserHeader is set to the caller's login by tailscale serve.
+	TailscaleUserHeader = "Tailscale-User-Login"
+
+	// AnonymousClient is the client name of requests that carry no identity.
+	AnonymousClient = "anonymous"
+	// UnknownClient is the client name of requests with a bearer token that is not mapped
+	// to a client.
+	UnknownClient = "unknown"
+)
+
+// ClientIdentifier maps callers to stable client names used to attribute metrics. Callers are
+// identified, in order, by a known bearer token, the X-Client-Name header, or the Tailscale
+// login set by tailscale serve. Headers are self reported, so the client name attributes
+// usage but does not authenticate the caller; Account names who usage is charged to.
+type ClientIdentifier struct {
+	// tokens maps bearer tokens to client names. Tokens are never used as names.
+	tokens map[string]string
+}
+
+// NewClientIdentifier creates a ClientIdentifier that names requests carrying one of the
+// bearer tokens after the client it maps to, e.g. {"sk-...": "twitch-bot"}.
+func NewClientIdentifier(tokens map[string]string) *ClientIdentifier {
+	return &ClientIdentifier{tokens: tokens}
+}
+
+// ParseClientTokens parses a comma separated list of name=token pairs, e.g.
+// "eleduck-analytics=sk-1,twitch-bot=sk-2", into a token to client name map. Errors name
+// entries by their position so they never contain a token.
+func ParseClientTokens(s string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for i, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, token, ok := strings.Cut(pair, "=")
+		if !ok || name == "" || token == "" {
+			return nil, fmt.Errorf("client token entry %d must be name=token", i+1)
+		}
+		if other, ok := tokens[token]; ok && other != name {
+			return nil, fmt.Errorf("client token entry %d reuses the token of client %q", i+1, other)
+		}
+		tokens[token] = name
+	}
+	return tokens, nil
+}
+
+// Identify returns the client name of the request, AnonymousClient when it carries no
+// identity, or UnknownClient when its only identity is an unmapped bearer token.
+func (id *ClientIdentifier) Identify(r *http.Request) string {
+	account, authenticated := id.authenticate(r)
+	if authenticated {
+		return account
+	}
+	if name := strings.TrimSpace(r.Header.Get(ClientNameHeader)); name != "" {
+		return name
+	}
+	if login := strings.TrimSpace(r.Header.Get(TailscaleUserHeader)); login != "" {
+		return login
+	}
+	return account
+}
+
+// Account returns the name of the account budgets and rate limits of the request are charged
+// to. Unlike Identify it ignores the self reported headers, so a caller cannot escape its limits
+// or use up another client's by naming itself: requests with a known bearer token are charged
+// to its client, and all other requests share UnknownClient or AnonymousClient.
+func (id *ClientIdentifier) Account(r *http.Request) string {
+	account, _ := id.authenticate(r)
+	return account
+}
+
+// authenticate returns the client of the request's bearer token and true if the token is
+// known, and otherwise UnknownClient or AnonymousClient and false.
+func (id *ClientIdentifier) authenticate(r *http.Request) (string, bool) {
+	token, hasToken := bearerToken(r)
+	if name, ok := id.tokens[token]; ok && hasToken {
+		return name, true
+	}
+	if hasToken {
+		return UnknownClient, false
+	}
+	return AnonymousClient, false
+}
+
+type clientKey struct{}
+
+// WithClient returns a copy of ctx that attributes the request made with it to the named
+// client, e.g. when a proxy identified the caller before replacing its credentials.
+func WithClient(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, clientKey{}, name)
+}
+
+// bearerToken returns the token of a bearer Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
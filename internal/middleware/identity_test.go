@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestParseClientTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    map[string]string
+		wantErr string
+	}{
+		{name: "empty", spec: "", want: map[string]string{}},
+		{
+			name: "pairs",
+			spec: " analytics=sk-1, twitch-bot=sk-2,",
+			want: map[string]string{"sk-1": "analytics", "sk-2": "twitch-bot"},
+		},
+		{name: "repeated pair", spec: "bot=sk-1,bot=sk-1", want: map[string]string{"sk-1": "bot"}},
+		{name: "missing name", spec: "bot=sk-1,=sk-secret", wantErr: "entry 2"},
+		{name: "missing separator", spec: "sk-secret", wantErr: "entry 1"},
+		{name: "token of two clients", spec: "bot=sk-secret,other=sk-secret", wantErr: "entry 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseClientTokens(tt.spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one naming %s", err, tt.wantErr)
+				}
+				if strings.Contains(err.Error(), "sk-secret") {
+					t.Errorf("error %q contains the token", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseClientTokens: %v", err)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("tokens = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,83 +2,238 @@ package middleware
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
 	"net/http"
-	"os"
-	"time"
+	"strings"
 
 	"github.com/soypete/pedro-ops/types"
 )
 
+// errEmptyResponse is returned when the body is valid json but carries neither a model nor usage,
+// e.g. an error envelope.
+var errEmptyResponse = errors.New("response has no model or usage")
+
+// errChatResponse is returned when a text completions body holds chat messages instead of text.
+var errChatResponse = errors.New("completions response holds chat messages")
+
 // OpenAIMiddleware handles OpenAI API requests and extracts metrics
 type OpenAIMiddleware struct {
-	apiKey     string
-	httpClient *http.Client
+	identifier *ClientIdentifier
+}
+
+// Option configures an OpenAIMiddleware.
+type Option func(*OpenAIMiddleware)
+
+// WithClientIdentifier sets the client of every recorded request to the name id identifies
+// the caller as. Without it the client is left empty.
+func WithClientIdentifier(id *ClientIdentifier) Option {
+	return func(m *OpenAIMiddleware) {
+		m.identifier = id
+	}
 }
 
 // NewOpenAIMiddleware creates a new OpenAI middleware instance
-func NewOpenAIMiddleware() *OpenAIMiddleware {
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
-		apiKey = "test"
+func NewOpenAIMiddleware(opts ...Option) *OpenAIMiddleware {
+	m := &OpenAIMiddleware{}
+	for _, opt := range opts {
+		opt(m)
 	}
+	return m
+}
 
-	return &OpenAIMiddleware{
-		apiKey: apiKey,
-		httpClient: &http.Client{
-			Timeout: 60 * time.Second,
-		},
+// identifyClient returns the client set on the request context with WithClient, otherwise
+// the client name of the request, or an empty string when no ClientIdentifier is configured.
+func (m *OpenAIMiddleware) identifyClient(r *http.Request) string {
+	if name, ok := r.Context().Value(clientKey{}).(string); ok {
+		return name
+	}
+	if m.identifier == nil {
+		return ""
 	}
+	return m.identifier.Identify(r)
 }
 
 // ExtractMetrics extracts metrics from the response body and updates
-// the response metrics struct for the given endpoint.
+// the response metrics struct for the given endpoint. It returns an
+// *UnknownEndpointError, *MalformedResponseError or *APIError when the
+// body does not hold a result for the endpoint. For an *APIError the
+// error type and code are set on metrics.
 func (m *OpenAIMiddleware) ExtractMetrics(
 	responseBody []byte,
 	metrics *types.ResponseMetrics,
 	endpoint string,
-) {
+) error {
+	var err error
 	switch endpoint {
-	case "completions":
-		m.extractCompletionMetrics(responseBody, metrics)
-	case "embeddings":
-		m.extractEmbeddingMetrics(responseBody, metrics)
+	case types.EndpointChatCompletions:
+		err = m.extractChatCompletionMetrics(responseBody, metrics)
+	case types.EndpointCompletions:
+		err = m.extractCompletionMetrics(responseBody, metrics)
+	case types.EndpointEmbeddings:
+		err = m.extractEmbeddingMetrics(responseBody, metrics)
+	default:
+		return &UnknownEndpointError{Endpoint: endpoint}
+	}
+	if err == nil {
+		return nil
 	}
+	if apiErr := parseAPIError(responseBody, endpoint); apiErr != nil {
+		setAPIErrorMetrics(apiErr, metrics)
+		return apiErr
+	}
+	return &MalformedResponseError{Endpoint: endpoint, Err: err}
 }
 
-func (m *OpenAIMiddleware) extractCompletionMetrics(
+// ExtractErrorReason returns a short reason for an error returned by ExtractMetrics.
+func ExtractErrorReason(err error) string {
+	var apiErr *APIError
+	var unknownErr *UnknownEndpointError
+	switch {
+	case errors.As(err, &apiErr):
+		return ReasonAPIError
+	case errors.As(err, &unknownErr):
+		return ReasonUnknownEndpoint
+	default:
+		return ReasonMalformed
+	}
+}
+
+// EndpointFromPath returns the endpoint name used by ExtractMetrics for the given
+// request path, or an empty string if the path is not a supported OpenAI endpoint.
+func EndpointFromPath(path string) string {
+	path = strings.TrimSuffix(path, "/")
+	switch {
+	case strings.HasSuffix(path, "/chat/completions"):
+		return types.EndpointChatCompletions
+	case strings.HasSuffix(path, "/completions"):
+		return types.EndpointCompletions
+	case strings.HasSuffix(path, "/embeddings"):
+		return types.EndpointEmbeddings
+	default:
+		return ""
+	}
+}
+
+func (m *OpenAIMiddleware) extractChatCompletionMetrics(
 	responseBody []byte,
 	metrics *types.ResponseMetrics,
-) {
+) error {
 	var response types.ChatCompletionResponse
 	if err := json.Unmarshal(responseBody, &response); err != nil {
-		log.Printf("Error parsing completion response: %v", err)
-		return
+		return err
+	}
+	if response.Model == "" && response.Usage.TotalTokens == 0 {
+		return errEmptyResponse
 	}
 
 	metrics.Model = response.Model
-	metrics.PromptTokens = response.Usage.PromptTokens
-	metrics.CompletionTokens = response.Usage.CompletionTokens
-	metrics.TotalTokens = response.Usage.TotalTokens
+	setUsageMetrics(&response.Usage, metrics)
+	setChoiceMetrics(response.Choices, metrics)
+	setServerTimings(response.Timings, metrics)
 
-	if len(response.Choices) > 0 && response.Choices[0].Message.Content != "" {
+	// without streaming the whole completion arrives at once, so the first token is
+	// only observable as the first response byte.
+	if len(response.Choices) > 0 && response.Choices[0].Message.Content != "" && metrics.FirstTokenTime.IsZero() {
 		metrics.FirstTokenTime = metrics.ResponseStartTime
 	}
+	return nil
+}
+
+func (m *OpenAIMiddleware) extractCompletionMetrics(
+	responseBody []byte,
+	metrics *types.ResponseMetrics,
+) error {
+	var response types.CompletionResponse
+	if err := json.Unmarshal(responseBody, &response); err != nil {
+		return err
+	}
+	if response.Model == "" && response.Usage.TotalTokens == 0 {
+		return errEmptyResponse
+	}
+
+	if isChatResponse(responseBody, response.Choices) {
+		return errChatResponse
+	}
+
+	metrics.Model = response.Model
+	setUsageMetrics(&response.Usage, metrics)
+	setServerTimings(response.Timings, metrics)
+	if len(response.Choices) > 0 {
+		metrics.FinishReason = response.Choices[0].FinishReason
+		if response.Choices[0].Text != "" && metrics.FirstTokenTime.IsZero() {
+			metrics.FirstTokenTime = metrics.ResponseStartTime
+		}
+	}
+	return nil
+}
+
+// isChatResponse reports whether a text completions body is a chat completion, whose choices
+// have a message and no text, so it is not recorded as a completion without output.
+func isChatResponse(responseBody []byte, choices []types.CompletionChoice) bool {
+	if len(choices) == 0 || choices[0].Text != "" {
+		return false
+	}
+	var chat struct {
+		Choices []struct {
+			Message json.RawMessage `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(responseBody, &chat); err != nil {
+		return false
+	}
+	return len(chat.Choices) > 0 && len(chat.Choices[0].Message) > 0 && string(chat.Choices[0].Message) != "null"
+}
+
+// setUsageMetrics copies the token counts and their details from usage into metrics.
+func setUsageMetrics(usage *types.Usage, metrics *types.ResponseMetrics) {
+	metrics.PromptTokens = usage.PromptTokens
+	metrics.CompletionTokens = usage.CompletionTokens
+	metrics.TotalTokens = usage.TotalTokens
+	metrics.CachedTokens = usage.PromptTokensDetails.CachedTokens
+	metrics.ReasoningTokens = usage.CompletionTokensDetails.ReasoningTokens
+	metrics.AcceptedPredictionTokens = usage.CompletionTokensDetails.AcceptedPredictionTokens
+	metrics.RejectedPredictionTokens = usage.CompletionTokensDetails.RejectedPredictionTokens
+}
+
+// setServerTimings sets the llama.cpp timings, using its kv cache count as the cached prompt
+// tokens when the usage does not report them.
+func setServerTimings(timings *types.LlamaCppTimings, metrics *types.ResponseMetrics) {
+	metrics.ServerTimings = timings
+	if timings != nil && metrics.CachedTokens == 0 {
+		metrics.CachedTokens = timings.CacheN
+	}
+}
+
+// setChoiceMetrics sets the finish reason and tool call metrics from the response choices.
+func setChoiceMetrics(choices []types.ChatCompletionChoice, metrics *types.ResponseMetrics) {
+	if len(choices) > 0 {
+		metrics.FinishReason = choices[0].FinishReason
+	}
+	for i := range choices {
+		for _, call := range choices[i].Message.ToolCalls {
+			metrics.ToolCalls++
+			metrics.ToolNames = append(metrics.ToolNames, call.Function.Name)
+		}
+	}
 }
 
 func (m *OpenAIMiddleware) extractEmbeddingMetrics(
 	responseBody []byte,
 	metrics *types.ResponseMetrics,
-) {
+) error {
 	var response types.EmbeddingResponse
 	if err := json.Unmarshal(responseBody, &response); err != nil {
-		log.Printf("Error parsing embedding response: %v", err)
-		return
+		return err
+	}
+	if response.Model == "" && response.Usage.TotalTokens == 0 {
+		return errEmptyResponse
 	}
 
 	metrics.Model = response.Model
-	metrics.PromptTokens = response.Usage.PromptTokens
-	metrics.TotalTokens = response.Usage.TotalTokens
+	setUsageMetrics(&response.Usage, metrics)
 	metrics.CompletionTokens = 0
-	metrics.FirstTokenTime = metrics.ResponseStartTime
+	if metrics.FirstTokenTime.IsZero() {
+		metrics.FirstTokenTime = metrics.ResponseStartTime
+	}
+	return nil
 }
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/soypete/pedro-ops/types"
+)
+
+func TestExtractCompletionMetrics(t *testing.T) {
+	const usage = `"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}`
+	tests := []struct {
+		name      string
+		body      string
+		malformed bool
+	}{
+		{
+			name: "text completion",
+			body: `{"model":"gpt-oss-20b","choices":[{"text":"hi there","finish_reason":"stop"}],` + usage + `}`,
+		},
+		{
+			name: "empty text",
+			body: `{"model":"gpt-oss-20b","choices":[{"text":"","finish_reason":"length"}],` + usage + `}`,
+		},
+		{
+			name: "chat completion body",
+			body: `{"model":"gpt-oss-20b","choices":[{"message":{"role":"assistant","content":"hi"},` +
+				`"finish_reason":"stop"}],` + usage + `}`,
+			malformed: true,
+		},
+	}
+	m := NewOpenAIMiddleware()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var metrics types.ResponseMetrics
+			err := m.ExtractMetrics([]byte(tt.body), &metrics, types.EndpointCompletions)
+			var malformed *MalformedResponseError
+			if got := errors.As(err, &malformed); got != tt.malformed {
+				t.Fatalf("ExtractMetrics error = %v, want malformed %v", err, tt.malformed)
+			}
+			if !tt.malformed && metrics.TotalTokens != 5 {
+				t.Errorf("total tokens = %d, want 5", metrics.TotalTokens)
+			}
+		})
+	}
+}
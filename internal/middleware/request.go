@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/soypete/pedro-ops/types"
+)
+
+// ExtractRequestMetrics reads the requested model and parameters from the request body sent
+// to the given endpoint and sets them on metrics. Bodies that are not a valid request leave
+// metrics unchanged; the server rejects them and its error response is recorded instead.
+func (m *OpenAIMiddleware) ExtractRequestMetrics(
+	requestBody []byte,
+	metrics *types.ResponseMetrics,
+	endpoint string,
+) {
+	switch endpoint {
+	case types.EndpointChatCompletions:
+		var req types.ChatCompletionRequest
+		if json.Unmarshal(requestBody, &req) != nil {
+			return
+		}
+		metrics.RequestedModel = req.Model
+		metrics.MaxTokens = firstSet(req.MaxCompletionTokens, req.MaxTokens)
+		metrics.Temperature = req.Temperature
+		metrics.TopP = req.TopP
+		metrics.StreamRequested = req.Stream
+		metrics.MessageCount = len(req.Messages)
+		metrics.ToolCount = len(req.Tools)
+	case types.EndpointCompletions:
+		var req types.CompletionRequest
+		if json.Unmarshal(requestBody, &req) != nil {
+			return
+		}
+		metrics.RequestedModel = req.Model
+		metrics.MaxTokens = firstSet(req.MaxTokens)
+		metrics.Temperature = req.Temperature
+		metrics.TopP = req.TopP
+		metrics.StreamRequested = req.Stream
+		metrics.MessageCount = countInputs(req.Prompt)
+	case types.EndpointEmbeddings:
+		var req types.EmbeddingRequest
+		if json.Unmarshal(requestBody, &req) != nil {
+			return
+		}
+		metrics.RequestedModel = req.Model
+		metrics.MessageCount = countInputs(req.Input)
+	}
+}
+
+// firstSet returns the first limit that is set, or 0.
+func firstSet(limits ...*int) int {
+	for _, limit := range limits {
+		if limit != nil {
+			return *limit
+		}
+	}
+	return 0
+}
+
+// countInputs returns the number of prompts in a prompt or input field, which holds a string,
+// a token array, or an array of either.
+func countInputs(raw json.RawMessage) int {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return 0
+	}
+	if raw[0] != '[' {
+		return 1
+	}
+	var inputs []json.RawMessage
+	if err := json.Unmarshal(raw, &inputs); err != nil || len(inputs) == 0 {
+		return 0
+	}
+	// a single token array is one prompt
+	if first := bytes.TrimSpace(inputs[0]); len(first) > 0 && first[0] != '"' && first[0] != '[' {
+		return 1
+	}
+	return len(inputs)
+}
@@ -0,0 +1,262 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/soypete/pedro-ops/types"
+)
+
+var (
+	dataPrefix = []byte("data:")
+	doneMarker = []byte("[DONE]")
+	errorKey   = []byte(`"error"`)
+)
+
+// StreamAccumulator consumes the server sent events of a `stream: true` chat or text
+// completion and reassembles them into a single response while stamping the time the first
+// token arrived, reasoning included. Text completion chunks are reassembled as chat messages. It
+// implements io.Writer so the raw stream can be teed into it as it is read by the caller.
+type StreamAccumulator struct {
+	metrics  *types.ResponseMetrics
+	response types.ChatCompletionResponse
+	// pending holds a partial line until its newline arrives.
+	pending []byte
+	// contentChunks counts the chunks that carried content or reasoning, used as the
+	// completion token count when the server does not send usage.
+	contentChunks int
+	chunks        int
+	lastTokenTime time.Time
+	done          bool
+	// err is the first error found in the stream.
+	err error
+}
+
+// NewStreamAccumulator creates an accumulator that writes its results into metrics.
+// metrics.ResponseStartTime should already be set to when the response headers arrived.
+func (m *OpenAIMiddleware) NewStreamAccumulator(metrics *types.ResponseMetrics) *StreamAccumulator {
+	metrics.Streamed = true
+	return &StreamAccumulator{metrics: metrics}
+}
+
+// Write parses every complete `data:` line in p. Partial lines are buffered until the
+// rest of the line is written.
+func (a *StreamAccumulator) Write(p []byte) (int, error) {
+	a.pending = append(a.pending, p...)
+	for {
+		i := bytes.IndexByte(a.pending, '\n')
+		if i < 0 {
+			break
+		}
+		a.processLine(bytes.TrimSpace(a.pending[:i]))
+		a.pending = a.pending[i+1:]
+	}
+	return len(p), nil
+}
+
+func (a *StreamAccumulator) processLine(line []byte) {
+	if !bytes.HasPrefix(line, dataPrefix) {
+		// comments, event names and blank separators carry no payload.
+		return
+	}
+	payload := bytes.TrimSpace(line[len(dataPrefix):])
+	if bytes.Equal(payload, doneMarker) {
+		a.done = true
+		return
+	}
+
+	// servers report failures mid stream as an error envelope in a data line.
+	if bytes.Contains(payload, errorKey) {
+		if apiErr := parseAPIError(payload, a.metrics.Endpoint); apiErr != nil {
+			a.setErr(apiErr)
+			return
+		}
+	}
+
+	if a.metrics.Endpoint == types.EndpointCompletions {
+		var chunk types.CompletionResponse
+		if err := json.Unmarshal(payload, &chunk); err != nil {
+			a.setErr(&MalformedResponseError{Endpoint: a.metrics.Endpoint, Err: err})
+			return
+		}
+		a.addChunk(chatChunk(&chunk))
+		return
+	}
+
+	var chunk types.ChatCompletionResponse
+	if err := json.Unmarshal(payload, &chunk); err != nil {
+		a.setErr(&MalformedResponseError{Endpoint: a.metrics.Endpoint, Err: err})
+		return
+	}
+	a.addChunk(&chunk)
+}
+
+func (a *StreamAccumulator) setErr(err error) {
+	if a.err == nil {
+		a.err = err
+	}
+}
+
+// chatChunk converts a text completion chunk into a chat completion chunk whose deltas
+// carry the text.
+func chatChunk(chunk *types.CompletionResponse) *types.ChatCompletionResponse {
+	converted := &types.ChatCompletionResponse{
+		ID:      chunk.ID,
+		Object:  chunk.Object,
+		Created: chunk.Created,
+		Model:   chunk.Model,
+		Usage:   chunk.Usage,
+		Timings: chunk.Timings,
+		Choices: make([]types.ChatCompletionChoice, len(chunk.Choices)),
+	}
+	for i, choice := range chunk.Choices {
+		converted.Choices[i] = types.ChatCompletionChoice{
+			Index:        choice.Index,
+			FinishReason: choice.FinishReason,
+			Delta:        &types.ChatCompletionMessage{Content: choice.Text},
+		}
+	}
+	return converted
+}
+
+func (a *StreamAccumulator) addChunk(chunk *types.ChatCompletionResponse) {
+	a.chunks++
+	if a.response.ID == "" {
+		a.response.ID = chunk.ID
+		a.response.Created = chunk.Created
+		a.response.Object = chunk.Object
+	}
+	if chunk.Model != "" {
+		a.response.Model = chunk.Model
+	}
+	// with stream_options.include_usage the final chunk has no choices and carries usage.
+	if chunk.Usage.TotalTokens > 0 {
+		a.response.Usage = chunk.Usage
+	}
+	// llama.cpp sends its timings with the final chunk.
+	if chunk.Timings != nil {
+		a.response.Timings = chunk.Timings
+	}
+
+	for i := range chunk.Choices {
+		delta := chunk.Choices[i].Delta
+		choice := a.choice(chunk.Choices[i].Index)
+		choice.Delta = delta
+		if chunk.Choices[i].FinishReason != "" {
+			choice.FinishReason = chunk.Choices[i].FinishReason
+		}
+		if delta == nil {
+			continue
+		}
+		if delta.Role != "" {
+			choice.Message.Role = delta.Role
+		}
+		if delta.Content == "" && delta.Refusal == "" && delta.ReasoningContent == "" && len(delta.ToolCalls) == 0 {
+			continue
+		}
+		a.stampToken(time.Now())
+		choice.Message.Content += delta.Content
+		choice.Message.Refusal += delta.Refusal
+		choice.Message.ReasoningContent += delta.ReasoningContent
+		for j := range delta.ToolCalls {
+			addToolCallDelta(&choice.Message, &delta.ToolCalls[j])
+		}
+		a.contentChunks++
+	}
+}
+
+// stampToken records the arrival time of a content or reasoning chunk.
+func (a *StreamAccumulator) stampToken(now time.Time) {
+	if a.metrics.FirstTokenTime.IsZero() {
+		a.metrics.FirstTokenTime = now
+	} else {
+		a.metrics.InterTokenLatencies = append(a.metrics.InterTokenLatencies, now.Sub(a.lastTokenTime))
+	}
+	a.lastTokenTime = now
+}
+
+// addToolCallDelta merges a streamed tool call delta into the tool call with the same index.
+// The id, type and name arrive in the first delta and the arguments are split across the rest.
+func addToolCallDelta(message *types.ChatCompletionMessage, delta *types.ToolCall) {
+	index := len(message.ToolCalls)
+	if delta.Index != nil {
+		index = *delta.Index
+	}
+	for i := range message.ToolCalls {
+		call := &message.ToolCalls[i]
+		if call.Index == nil || *call.Index != index {
+			continue
+		}
+		if delta.ID != "" {
+			call.ID = delta.ID
+		}
+		if delta.Type != "" {
+			call.Type = delta.Type
+		}
+		call.Function.Name += delta.Function.Name
+		call.Function.Arguments += delta.Function.Arguments
+		return
+	}
+	call := *delta
+	call.Index = &index
+	message.ToolCalls = append(message.ToolCalls, call)
+}
+
+// choice returns the accumulated choice with the given index, adding it if needed.
+func (a *StreamAccumulator) choice(index int) *types.ChatCompletionChoice {
+	for i := range a.response.Choices {
+		if a.response.Choices[i].Index == index {
+			return &a.response.Choices[i]
+		}
+	}
+	a.response.Choices = append(a.response.Choices, types.ChatCompletionChoice{Index: index})
+	return &a.response.Choices[len(a.response.Choices)-1]
+}
+
+// Finish flushes any trailing line and copies the accumulated model and usage into the
+// metrics. It should be called once the stream has been fully read. It returns the first
+// *MalformedResponseError or *APIError found in the stream, or a *MalformedResponseError
+// if the stream held no chunks.
+func (a *StreamAccumulator) Finish() error {
+	if len(a.pending) > 0 {
+		a.processLine(bytes.TrimSpace(a.pending))
+		a.pending = nil
+	}
+	if a.err != nil {
+		setAPIErrorMetrics(a.err, a.metrics)
+		return a.err
+	}
+	if a.chunks == 0 {
+		return &MalformedResponseError{Endpoint: a.metrics.Endpoint, Err: errors.New("no chunks in event stream")}
+	}
+
+	a.metrics.Model = a.response.Model
+	setUsageMetrics(&a.response.Usage, a.metrics)
+	setChoiceMetrics(a.response.Choices, a.metrics)
+	setServerTimings(a.response.Timings, a.metrics)
+	if a.metrics.CompletionTokens == 0 {
+		// llama-server emits one token per chunk, so this is a close estimate when the
+		// client did not ask for usage.
+		a.metrics.CompletionTokens = a.contentChunks
+		a.metrics.TotalTokens = a.metrics.PromptTokens + a.contentChunks
+	}
+	return nil
+}
+
+// Response returns the chat completion reassembled from the stream.
+func (a *StreamAccumulator) Response() types.ChatCompletionResponse {
+	return a.response
+}
+
+// Done reports whether the `data: [DONE]` terminator has been seen.
+func (a *StreamAccumulator) Done() bool {
+	return a.done
+}
+
+// IsEventStream reports whether the content type is a server sent event stream.
+func IsEventStream(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/event-stream")
+}
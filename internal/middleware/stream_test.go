@@ -0,0 +1,178 @@
+package middleware
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/soypete/pedro-ops/types"
+)
+
+// writeEvents writes each event to the accumulator as a separate data line.
+func writeEvents(t *testing.T, a *StreamAccumulator, events ...string) {
+	t.Helper()
+	for _, event := range events {
+		if _, err := a.Write([]byte("data: " + event + "\n\n")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+}
+
+func TestStreamAccumulatorReasoning(t *testing.T) {
+	metrics := &types.ResponseMetrics{Endpoint: types.EndpointChatCompletions}
+	a := NewOpenAIMiddleware().NewStreamAccumulator(metrics)
+	writeEvents(t, a,
+		`{"id":"1","model":"gpt-oss-20b","choices":[{"index":0,"delta":{"role":"assistant"}}]}`,
+		`{"id":"1","model":"gpt-oss-20b","choices":[{"index":0,"delta":{"reasoning_content":"Let me"}}]}`,
+		`{"id":"1","model":"gpt-oss-20b","choices":[{"index":0,"delta":{"reasoning_content":" think"}}]}`,
+	)
+	time.Sleep(time.Millisecond)
+	contentTime := time.Now()
+	writeEvents(t, a,
+		`{"id":"1","model":"gpt-oss-20b","choices":[{"index":0,"delta":{"content":"Hi"}}]}`,
+		`{"id":"1","model":"gpt-oss-20b","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+		`[DONE]`,
+	)
+	if err := a.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	if metrics.FirstTokenTime.IsZero() || !metrics.FirstTokenTime.Before(contentTime) {
+		t.Errorf("first token at %s, want the reasoning chunk before the content at %s",
+			metrics.FirstTokenTime, contentTime)
+	}
+	if metrics.CompletionTokens != 3 {
+		t.Errorf("CompletionTokens = %d, want 3 counted chunks", metrics.CompletionTokens)
+	}
+	message := a.Response().Choices[0].Message
+	if message.ReasoningContent != "Let me think" || message.Content != "Hi" {
+		t.Errorf("message = %+v, want reasoning %q and content %q", message, "Let me think", "Hi")
+	}
+}
+
+func TestStreamAccumulator(t *testing.T) {
+	const toolStream = `data: {"id":"1","model":"gpt-oss-20b","choices":[{"index":0,"delta":{"role":"assistant",` +
+		`"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":""}}]}}]}
+
+data: {"id":"1","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]}}]}
+
+data: {"id":"1","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Paris\"}"}}]}}]}
+
+data: {"id":"1","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}
+
+data: {"id":"1","choices":[],"usage":{"prompt_tokens":12,"completion_tokens":9,"total_tokens":21}}
+
+data: [DONE]
+
+`
+	const textStream = `data: {"id":"1","model":"gpt-oss-20b","choices":[{"index":0,"delta":{"content":"Hel"}}]}
+
+: keep-alive
+
+data: {"id":"1","choices":[{"index":0,"delta":{"content":"lo"}}]}
+
+data: {"id":"1","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}
+
+data: [DONE]
+`
+	tests := []struct {
+		name      string
+		stream    string
+		chunkSize int
+		check     func(t *testing.T, a *StreamAccumulator, m *types.ResponseMetrics)
+	}{
+		{
+			name:      "tool call deltas split across writes",
+			stream:    toolStream,
+			chunkSize: 7,
+			check: func(t *testing.T, a *StreamAccumulator, m *types.ResponseMetrics) {
+				t.Helper()
+				calls := a.Response().Choices[0].Message.ToolCalls
+				if len(calls) != 1 || calls[0].ID != "call_1" || calls[0].Function.Name != "get_weather" ||
+					calls[0].Function.Arguments != `{"city":"Paris"}` {
+					t.Errorf("tool calls = %+v, want one get_weather call for Paris", calls)
+				}
+				if m.ToolCalls != 1 || m.FinishReason != "tool_calls" {
+					t.Errorf("ToolCalls = %d, FinishReason = %q", m.ToolCalls, m.FinishReason)
+				}
+			},
+		},
+		{
+			name:      "usage chunk",
+			stream:    toolStream,
+			chunkSize: len(toolStream),
+			check: func(t *testing.T, a *StreamAccumulator, m *types.ResponseMetrics) {
+				t.Helper()
+				if m.PromptTokens != 12 || m.CompletionTokens != 9 || m.TotalTokens != 21 {
+					t.Errorf("tokens = %d/%d/%d, want the usage chunk's 12/9/21",
+						m.PromptTokens, m.CompletionTokens, m.TotalTokens)
+				}
+			},
+		},
+		{
+			name:      "content split mid line without usage",
+			stream:    textStream,
+			chunkSize: 3,
+			check: func(t *testing.T, a *StreamAccumulator, m *types.ResponseMetrics) {
+				t.Helper()
+				if got := a.Response().Choices[0].Message.Content; got != "Hello" {
+					t.Errorf("content = %q, want Hello", got)
+				}
+				if m.Model != "gpt-oss-20b" || m.CompletionTokens != 2 || len(m.InterTokenLatencies) != 1 {
+					t.Errorf("model %q, completion tokens %d, %d inter token latencies",
+						m.Model, m.CompletionTokens, len(m.InterTokenLatencies))
+				}
+				if !a.Done() {
+					t.Error("Done() = false after [DONE]")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := &types.ResponseMetrics{Endpoint: types.EndpointChatCompletions}
+			a := NewOpenAIMiddleware().NewStreamAccumulator(metrics)
+			for rest := tt.stream; rest != ""; {
+				n := min(tt.chunkSize, len(rest))
+				if _, err := a.Write([]byte(rest[:n])); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+				rest = rest[n:]
+			}
+			if err := a.Finish(); err != nil {
+				t.Fatalf("Finish: %v", err)
+			}
+			tt.check(t, a, metrics)
+		})
+	}
+}
+
+func TestStreamAccumulatorErrors(t *testing.T) {
+	isAPIError := func(err error) bool {
+		var apiErr *APIError
+		return errors.As(err, &apiErr)
+	}
+	isMalformed := func(err error) bool {
+		var malformed *MalformedResponseError
+		return errors.As(err, &malformed)
+	}
+	tests := []struct {
+		name   string
+		stream string
+		is     func(error) bool
+	}{
+		{"error event", `data: {"error":{"message":"context too long","type":"invalid_request_error"}}` + "\n", isAPIError},
+		{"malformed chunk", "data: {not json}\n", isMalformed},
+		{"no chunks", "data: [DONE]\n", isMalformed},
+	}
+	for _, tt := range tests {
+		metrics := &types.ResponseMetrics{Endpoint: types.EndpointChatCompletions}
+		a := NewOpenAIMiddleware().NewStreamAccumulator(metrics)
+		if _, err := a.Write([]byte(tt.stream)); err != nil {
+			t.Fatalf("%s: write: %v", tt.name, err)
+		}
+		if err := a.Finish(); !tt.is(err) {
+			t.Errorf("%s: Finish() = %v (%T)", tt.name, err, err)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/soypete/pedro-ops/types"
+)
+
+// Recorder records the metrics of a completed OpenAI API call.
+type Recorder interface {
+	RecordMetrics(metrics *types.ResponseMetrics)
+}
+
+// RecorderFunc adapts a function to the Recorder interface.
+type RecorderFunc func(metrics *types.ResponseMetrics)
+
+// RecordMetrics calls f(metrics).
+func (f RecorderFunc) RecordMetrics(metrics *types.ResponseMetrics) {
+	f(metrics)
+}
+
+type recorderKey struct{}
+
+// WithRecorder returns a copy of ctx that makes the Transport and Handler also record the
+// metrics of the request made with it to recorder, after their own recorder. It lets a caller
+// act on the metrics of one request, e.g. to reconcile its estimated usage.
+func WithRecorder(ctx context.Context, recorder Recorder) context.Context {
+	return context.WithValue(ctx, recorderKey{}, recorder)
+}
+
+// requestRecorder returns recorder followed by the recorder added to ctx with WithRecorder.
+func requestRecorder(ctx context.Context, recorder Recorder) Recorder {
+	extra, ok := ctx.Value(recorderKey{}).(Recorder)
+	if !ok {
+		return recorder
+	}
+	return RecorderFunc(func(metrics *types.ResponseMetrics) {
+		recorder.RecordMetrics(metrics)
+		extra.RecordMetrics(metrics)
+	})
+}
+
+// Transport is an http.RoundTripper that records metrics for every OpenAI API call made
+// through it. Response bodies are parsed as the caller reads them, so streamed responses
+// are passed through unbuffered.
+type Transport struct {
+	base     http.RoundTripper
+	mw       *OpenAIMiddleware
+	recorder Recorder
+}
+
+// NewTransport wraps base so that requests to OpenAI endpoints are recorded with recorder.
+// If base is nil http.DefaultTransport is used.
+func (m *OpenAIMiddleware) NewTransport(base http.RoundTripper, recorder Recorder) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &Transport{
+		base:     base,
+		mw:       m,
+		recorder: recorder,
+	}
+}
+
+// RoundTrip implements http.RoundTripper. Requests to paths that are not OpenAI endpoints
+// are passed through without being recorded.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := EndpointFromPath(req.URL.Path)
+	if endpoint == "" {
+		return t.base.RoundTrip(req)
+	}
+
+	body, req, err := readRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := &types.ResponseMetrics{
+		RequestStartTime: time.Now(),
+		Endpoint:         endpoint,
+		RequestSize:      int64(len(body)),
+		Client:           t.mw.identifyClient(req),
+	}
+	t.mw.ExtractRequestMetrics(body, metrics, endpoint)
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics.ResponseStartTime = time.Now()
+	metrics.StatusCode = resp.StatusCode
+	resp.Body = t.newRecordingBody(resp, metrics, requestRecorder(req.Context(), t.recorder))
+	return resp, nil
+}
+
+// readRequest reads the request body so the request parameters can be extracted, and
+// returns a clone of the request with a replayable body.
+func readRequest(req *http.Request) ([]byte, *http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, req, nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.Clone(req.Context())
+	req.ContentLength = int64(len(body))
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return body, req, nil
+}
+
+func (t *Transport) newRecordingBody(
+	resp *http.Response, metrics *types.ResponseMetrics, recorder Recorder,
+) *recordingBody {
+	return &recordingBody{
+		ReadCloser: resp.Body,
+		capture:    t.mw.newResponseCapture(metrics, resp.Header.Get("Content-Type"), recorder),
+	}
+}
+
+// recordingBody tees a response body as it is read and records the metrics once the body
+// has been read to EOF or closed.
+type recordingBody struct {
+	io.ReadCloser
+	capture *responseCapture
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.capture.write(p[:n])
+	}
+	if err == io.EOF {
+		b.capture.finish()
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	b.capture.finish()
+	return b.ReadCloser.Close()
+}
+
+// responseCapture parses a response body as it passes through and records the metrics
+// once the response is complete.
+type responseCapture struct {
+	metrics  *types.ResponseMetrics
+	mw       *OpenAIMiddleware
+	recorder Recorder
+
+	// stream is set for server sent event responses, otherwise the body is buffered.
+	stream *StreamAccumulator
+	buf    bytes.Buffer
+	size   int64
+	once   sync.Once
+}
+
+func (m *OpenAIMiddleware) newResponseCapture(
+	metrics *types.ResponseMetrics, contentType string, recorder Recorder,
+) *responseCapture {
+	c := &responseCapture{
+		metrics:  metrics,
+		mw:       m,
+		recorder: recorder,
+	}
+	if IsEventStream(contentType) {
+		c.stream = m.NewStreamAccumulator(metrics)
+	}
+	return c
+}
+
+func (c *responseCapture) write(p []byte) {
+	c.size += int64(len(p))
+	if c.stream != nil {
+		_, _ = c.stream.Write(p)
+		return
+	}
+	// the whole completion arrives at once, so the first byte is the first token.
+	if c.metrics.FirstTokenTime.IsZero() {
+		c.metrics.FirstTokenTime = time.Now()
+	}
+	c.buf.Write(p)
+}
+
+func (c *responseCapture) finish() {
+	c.once.Do(func() {
+		c.metrics.ResponseEndTime = time.Now()
+		c.metrics.ResponseSize = c.size
+		if c.stream != nil {
+			c.metrics.ExtractError = c.stream.Finish()
+		} else {
+			c.metrics.ExtractError = c.mw.ExtractMetrics(c.buf.Bytes(), c.metrics, c.metrics.Endpoint)
+		}
+		c.recorder.RecordMetrics(c.metrics)
+	})
+}
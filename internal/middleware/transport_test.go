@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/soypete/pedro-ops/types"
+)
+
+const chatRequest = `{"model":"gpt-oss","stream":false,"max_tokens":64,` +
+	`"messages":[{"role":"user","content":"hello"}]}`
+
+const chatResponse = `{"id":"chatcmpl-1","object":"chat.completion","model":"gpt-oss-20b",` +
+	`"choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}],` +
+	`"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`
+
+const chatStream = `data: {"id":"1","model":"gpt-oss-20b","choices":[{"index":0,"delta":{"content":"Hel"}}]}
+
+data: {"id":"1","choices":[{"index":0,"delta":{"content":"lo"}}]}
+
+data: {"id":"1","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}
+
+data: [DONE]
+
+`
+
+// recorded collects the metrics passed to its RecordMetrics.
+type recorded struct {
+	mu      sync.Mutex
+	metrics []*types.ResponseMetrics
+}
+
+func (r *recorded) RecordMetrics(metrics *types.ResponseMetrics) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, metrics)
+}
+
+func (r *recorded) get() []*types.ResponseMetrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.metrics
+}
+
+func TestTransport(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		response    string
+		tokens      int
+	}{
+		{"json", "application/json", chatResponse, 1},
+		{"event stream", "text/event-stream", chatStream, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreamBody string
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Errorf("read request: %v", err)
+				}
+				upstreamBody = string(body)
+				w.Header().Set("Content-Type", tt.contentType)
+				if _, err := io.WriteString(w, tt.response); err != nil {
+					t.Errorf("write response: %v", err)
+				}
+			}))
+			defer upstream.Close()
+
+			var rec, extra recorded
+			client := &http.Client{Transport: NewOpenAIMiddleware().NewTransport(nil, &rec)}
+			ctx := WithRecorder(t.Context(), &extra)
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, upstream.URL+"/v1/chat/completions",
+				strings.NewReader(chatRequest))
+			if err != nil {
+				t.Fatalf("new request: %v", err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("post: %v", err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("read response: %v", err)
+			}
+			if err := resp.Body.Close(); err != nil {
+				t.Fatalf("close response: %v", err)
+			}
+
+			if string(body) != tt.response {
+				t.Errorf("body = %s, want the upstream's response", body)
+			}
+			if upstreamBody != chatRequest {
+				t.Errorf("upstream body = %s, want %s", upstreamBody, chatRequest)
+			}
+			got := rec.get()
+			if len(got) != 1 || len(extra.get()) != 1 {
+				t.Fatalf("recorded %d and %d times, want once by each recorder", len(got), len(extra.get()))
+			}
+			m := got[0]
+			if m.ExtractError != nil {
+				t.Errorf("ExtractError = %v", m.ExtractError)
+			}
+			if m.Endpoint != types.EndpointChatCompletions || m.StatusCode != http.StatusOK {
+				t.Errorf("endpoint %q status %d, want chat_completions 200", m.Endpoint, m.StatusCode)
+			}
+			if m.Model != "gpt-oss-20b" || m.RequestedModel != "gpt-oss" {
+				t.Errorf("model %q requested %q, want gpt-oss-20b and gpt-oss", m.Model, m.RequestedModel)
+			}
+			if m.CompletionTokens != tt.tokens {
+				t.Errorf("CompletionTokens = %d, want %d", m.CompletionTokens, tt.tokens)
+			}
+			if m.RequestSize != int64(len(chatRequest)) || m.ResponseSize != int64(len(tt.response)) {
+				t.Errorf("sizes = %d and %d, want %d and %d", m.RequestSize, m.ResponseSize,
+					len(chatRequest), len(tt.response))
+			}
+			if m.FirstTokenTime.IsZero() || m.ResponseEndTime.Before(m.FirstTokenTime) {
+				t.Errorf("first token at %s, response end at %s", m.FirstTokenTime, m.ResponseEndTime)
+			}
+		})
+	}
+}
+
+func TestTransportPassesOtherPathsThrough(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.WriteString(w, `{"data":[]}`); err != nil {
+			t.Errorf("write response: %v", err)
+		}
+	}))
+	defer upstream.Close()
+
+	var rec recorded
+	client := &http.Client{Transport: NewOpenAIMiddleware().NewTransport(nil, &rec)}
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, upstream.URL+"/v1/models", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		t.Fatalf("close response: %v", err)
+	}
+	if n := len(rec.get()); n != 0 {
+		t.Errorf("recorded %d requests to /v1/models, want none", n)
+	}
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/soypete/pedro-ops/internal/middleware"
+	"github.com/soypete/pedro-ops/internal/ratelimit"
+	"github.com/soypete/pedro-ops/types"
+)
+
+const (
+	// bytesPerToken is the rough number of request body bytes per prompt token used to
+	// estimate the tokens of a request before it is sent.
+	bytesPerToken = 4
+	// defaultCompletionEstimate is the completion tokens estimated for requests without
+	// max_tokens.
+	defaultCompletionEstimate = 256
+	// maxRequestBody is the largest request body read to admit a request.
+	maxRequestBody = 32 << 20
+
+	// reasonBudget is the rejection reason of requests from clients without token budget left.
+	reasonBudget = "budget"
+)
+
+// admit routes each request to the upstream serving its model, and rejects requests from
+// accounts that have used up their token budget or exceed the rate limits of the account or the
+// model.
+func (p *Proxy) admit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", "",
+				fmt.Sprintf("read request body: %v", err))
+			return
+		}
+
+		endpoint := middleware.EndpointFromPath(r.URL.Path)
+		req := &types.ResponseMetrics{Endpoint: endpoint}
+		p.mw.ExtractRequestMetrics(body, req, endpoint)
+		// the upstream credentials replace the caller's, so the client is identified here.
+		r = r.WithContext(middleware.WithClient(r.Context(), p.identifier.Identify(r)))
+		// budgets and rate limits are charged to the authenticated account, as the client may be
+		// self reported.
+		account := p.identifier.Account(r)
+
+		r, ok := p.route(w, r, body, req)
+		if !ok {
+			return
+		}
+		model := req.RequestedModel
+		if p.quota != nil && !p.checkQuota(w, account, model) {
+			return
+		}
+		var res *ratelimit.Reservation
+		if p.limiter != nil {
+			res = p.limiter.Reserve(account, model, estimateTokens(body, req), time.Now())
+			setRateLimitHeaders(w.Header(), res.Status)
+			if !res.OK {
+				p.rejectRateLimited(w, account, model, res)
+				return
+			}
+			// tokens reserved for a request that never got a response are given back.
+			defer res.Reconcile(0)
+		}
+		r = r.WithContext(middleware.WithRecorder(r.Context(), p.usageRecorder(account, res)))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// usageRecorder charges the tokens of the response to the account's budget, and reconciles
+// them with the tokens reserved by res if it is not nil.
+func (p *Proxy) usageRecorder(account string, res *ratelimit.Reservation) middleware.Recorder {
+	return middleware.RecorderFunc(func(m *types.ResponseMetrics) {
+		// responses of failed attempts that are retried have no usage.
+		if retryable(m.StatusCode) {
+			return
+		}
+		if res != nil {
+			res.Reconcile(m.TotalTokens)
+		}
+		if p.quota != nil && m.TotalTokens > 0 {
+			p.charge(account, int64(m.TotalTokens))
+		}
+	})
+}
+
+// route picks the upstreams of the request and sets the requested model of req to the model
+// it is sent with, rewriting the body when an alias was resolved. It reports false when the
+// request was rejected.
+func (p *Proxy) route(
+	w http.ResponseWriter, r *http.Request, body []byte, req *types.ResponseMetrics,
+) (*http.Request, bool) {
+	upstreams, model, ok := p.router.Route(req.RequestedModel)
+	if !ok {
+		writeError(w, http.StatusNotFound, "invalid_request_error", "model_not_found",
+			fmt.Sprintf("the model %q is not served by this proxy", req.RequestedModel))
+		return r, false
+	}
+	if model != req.RequestedModel {
+		var err error
+		if body, err = rewriteModel(body, model); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+			return r, false
+		}
+		req.RequestedModel = model
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return r.WithContext(withRouting(r.Context(), &routing{upstreams: upstreams, body: body})), true
+}
+
+// rewriteModel returns the request body with its model replaced, keeping the other fields.
+func rewriteModel(body []byte, model string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, fmt.Errorf("decode request body: %w", err)
+	}
+	name, err := json.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+	fields["model"] = name
+	return json.Marshal(fields)
+}
+
+// checkQuota reports whether the account has token budget left, and otherwise rejects the
+// request.
+func (p *Proxy) checkQuota(w http.ResponseWriter, account, model string) bool {
+	remaining := p.quota.Remaining(account, time.Now())
+	if !remaining.Exhausted() {
+		return true
+	}
+	p.setBudgetGauges(account, remaining)
+	p.client.RecordRejection(account, model, reasonBudget)
+	writeError(w, http.StatusTooManyRequests, "insufficient_quota", "insufficient_quota",
+		fmt.Sprintf("token budget of client %s is exhausted", account))
+	return false
+}
+
+func (p *Proxy) rejectRateLimited(w http.ResponseWriter, account, model string, res *ratelimit.Reservation) {
+	p.client.RecordRejection(account, model, res.Reason)
+	retryAfter := max(1, int(res.RetryAfter.Round(time.Second)/time.Second))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeError(w, http.StatusTooManyRequests, res.Reason, "rate_limit_exceeded",
+		fmt.Sprintf("rate limit of %s per minute reached for client %s, retry in %s",
+			res.Reason, account, res.RetryAfter.Round(time.Millisecond)))
+}
+
+// estimateTokens estimates the tokens a request uses from the size of its body and its
+// completion limit, before the response reports the actual usage.
+func estimateTokens(body []byte, req *types.ResponseMetrics) int {
+	tokens := len(body) / bytesPerToken
+	if req.Endpoint == types.EndpointEmbeddings {
+		return tokens // embeddings generate no completion tokens
+	}
+	if req.MaxTokens > 0 {
+		return tokens + req.MaxTokens
+	}
+	return tokens + defaultCompletionEstimate
+}
+
+// setRateLimitHeaders sets the OpenAI x-ratelimit-* headers for the limits that apply.
+func setRateLimitHeaders(h http.Header, s ratelimit.Status) {
+	if s.LimitRequests > 0 {
+		h.Set("X-Ratelimit-Limit-Requests", strconv.Itoa(s.LimitRequests))
+		h.Set("X-Ratelimit-Remaining-Requests", strconv.Itoa(s.RemainingRequests))
+		h.Set("X-Ratelimit-Reset-Requests", s.ResetRequests.Round(time.Millisecond).String())
+	}
+	if s.LimitTokens > 0 {
+		h.Set("X-Ratelimit-Limit-Tokens", strconv.Itoa(s.LimitTokens))
+		h.Set("X-Ratelimit-Remaining-Tokens", strconv.Itoa(s.RemainingTokens))
+		h.Set("X-Ratelimit-Reset-Tokens", s.ResetTokens.Round(time.Millisecond).String())
+	}
+}
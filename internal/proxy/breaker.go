@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of an upstream's circuit breaker. The values are exported as the
+// openai_upstream_circuit_state gauge.
+type BreakerState int
+
+// Circuit breaker states.
+const (
+	// BreakerClosed lets every request through.
+	BreakerClosed BreakerState = iota
+	// BreakerHalfOpen lets a single probe request through after the cooldown.
+	BreakerHalfOpen
+	// BreakerOpen rejects requests until the cooldown has passed.
+	BreakerOpen
+)
+
+// breaker is a circuit breaker that opens after consecutive failures and lets a probe request
+// through once the cooldown has passed, closing again when the probe succeeds.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	// onChange is called with the new state, with mu held.
+	onChange func(BreakerState)
+
+	mu          sync.Mutex
+	state       BreakerState
+	consecutive int
+	openedAt    time.Time
+	probing     bool
+}
+
+func newBreaker(threshold int, cooldown time.Duration, onChange func(BreakerState)) *breaker {
+	b := &breaker{threshold: threshold, cooldown: cooldown, onChange: onChange}
+	onChange(BreakerClosed)
+	return b
+}
+
+// allow reports whether a request may be sent. Every allowed request must be followed by a
+// call to success, failure or release.
+func (b *breaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(BreakerHalfOpen)
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.consecutive = 0
+	b.probing = false
+	b.setState(BreakerClosed)
+}
+
+func (b *breaker) failure(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.consecutive++
+	b.probing = false
+	if b.state == BreakerHalfOpen || b.consecutive >= b.threshold {
+		b.openedAt = now
+		b.setState(BreakerOpen)
+	}
+}
+
+// release ends a request that neither succeeded nor failed, e.g. because the caller went away.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *breaker) setState(state BreakerState) {
+	if b.state != state {
+		b.state = state
+		b.onChange(state)
+	}
+}
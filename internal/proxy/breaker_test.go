@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	cooldown := 30 * time.Second
+	var states []BreakerState
+	b := newBreaker(2, cooldown, func(s BreakerState) { states = append(states, s) })
+
+	steps := []struct {
+		name    string
+		at      time.Duration
+		allow   bool
+		outcome string // success, failure or release of the allowed request
+		state   BreakerState
+	}{
+		{"first failure", 0, true, "failure", BreakerClosed},
+		{"success resets the count", 0, true, "success", BreakerClosed},
+		{"failure", 0, true, "failure", BreakerClosed},
+		{"second consecutive failure opens", 0, true, "failure", BreakerOpen},
+		{"open rejects", 10 * time.Second, false, "", BreakerOpen},
+		{"probe after the cooldown", cooldown, true, "release", BreakerHalfOpen},
+		{"released probe lets another through", cooldown, true, "failure", BreakerOpen},
+		{"failed probe reopens", cooldown + time.Second, false, "", BreakerOpen},
+		{"second probe", 2*cooldown + time.Second, true, "success", BreakerClosed},
+		{"closed again", 2*cooldown + time.Second, true, "success", BreakerClosed},
+	}
+	for _, s := range steps {
+		now := start.Add(s.at)
+		if got := b.allow(now); got != s.allow {
+			t.Fatalf("%s: allow = %v, want %v", s.name, got, s.allow)
+		}
+		switch s.outcome {
+		case "success":
+			b.success()
+		case "failure":
+			b.failure(now)
+		case "release":
+			b.release()
+		}
+		if b.state != s.state {
+			t.Fatalf("%s: state = %d, want %d", s.name, b.state, s.state)
+		}
+	}
+
+	want := []BreakerState{BreakerClosed, BreakerOpen, BreakerHalfOpen, BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if !slices.Equal(states, want) {
+		t.Errorf("state changes = %v, want %v", states, want)
+	}
+}
+
+func TestBreakerHalfOpenAllowsOneProbe(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	b := newBreaker(1, time.Second, func(BreakerState) {})
+	b.allow(now)
+	b.failure(now)
+
+	now = now.Add(time.Second)
+	if !b.allow(now) {
+		t.Fatal("probe was not allowed after the cooldown")
+	}
+	if b.allow(now) {
+		t.Error("second request was allowed while the probe is in flight")
+	}
+}
@@ -0,0 +1,24 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/soypete/pedro-ops/types"
+)
+
+// writeError writes an error in the OpenAI error envelope, so OpenAI clients surface the
+// message and type instead of failing to decode the body.
+func writeError(w http.ResponseWriter, status int, errorType, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	resp := types.ErrorResponse{Error: &types.ErrorDetail{
+		Message: message,
+		Type:    errorType,
+		Code:    types.ErrorCode(code),
+	}}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("write error response: %v", err)
+	}
+}
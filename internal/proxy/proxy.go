@@ -0,0 +1,230 @@
+// package proxy implements an OpenAI compatible reverse proxy that records metrics
+// for every exchange forwarded to the upstream llm server.
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/soypete/pedro-ops/internal/metrics"
+	"github.com/soypete/pedro-ops/internal/middleware"
+	"github.com/soypete/pedro-ops/internal/quota"
+	"github.com/soypete/pedro-ops/internal/ratelimit"
+	"github.com/soypete/pedro-ops/types"
+)
+
+// Proxy forwards OpenAI API requests to an upstream server and records metrics
+// for each response.
+type Proxy struct {
+	router       *Router
+	transports   map[string]http.RoundTripper
+	reverseProxy *httputil.ReverseProxy
+	client       *metrics.Client
+	mw           *middleware.OpenAIMiddleware
+	identifier   *middleware.ClientIdentifier
+	// quota is nil when no token budgets are enforced.
+	quota *quota.Tracker
+	// limiter is nil when requests and tokens per minute are not limited.
+	limiter *ratelimit.Limiter
+	retry   RetryPolicy
+	// breakers holds the circuit breaker of each upstream by name.
+	breakers map[string]*breaker
+	// fallbackURL is the upstream requests fail over to when no router is configured.
+	fallbackURL string
+}
+
+// Option configures a Proxy.
+type Option func(*Proxy)
+
+// WithClientIdentifier attributes every request to the client id identifies the caller as.
+// By default callers are only identified by the X-Client-Name and Tailscale headers.
+func WithClientIdentifier(id *middleware.ClientIdentifier) Option {
+	return func(p *Proxy) {
+		p.identifier = id
+	}
+}
+
+// WithQuota enforces the token budgets tracked by t. Requests from accounts whose budget is
+// exhausted are rejected with 429 insufficient_quota, and the total tokens of every response
+// are charged to its account, see middleware.ClientIdentifier.Account.
+func WithQuota(t *quota.Tracker) Option {
+	return func(p *Proxy) {
+		p.quota = t
+	}
+}
+
+// WithRateLimits limits the requests and tokens per minute of each client and model with l.
+// The tokens of a request are estimated up front and reconciled with the usage of its
+// response. Responses carry x-ratelimit-* headers describing the proxy's limits in place of
+// the upstream's, and rejected requests get a 429 rate_limit_exceeded error.
+func WithRateLimits(l *ratelimit.Limiter) Option {
+	return func(p *Proxy) {
+		p.limiter = l
+	}
+}
+
+// WithRouter routes each request to the upstream rt picks for its model, instead of sending
+// every request to the upstream passed to New. Requests for models without a route are
+// rejected with 404 model_not_found.
+func WithRouter(rt *Router) Option {
+	return func(p *Proxy) {
+		p.router = rt
+	}
+}
+
+// WithRetryPolicy retries failed upstream requests and opens the upstreams' circuit breakers as
+// configured by rp, instead of as by DefaultRetryPolicy.
+func WithRetryPolicy(rp RetryPolicy) Option {
+	return func(p *Proxy) {
+		p.retry = rp
+	}
+}
+
+// WithFallback fails requests over to the upstream base url when the upstream passed to New
+// keeps failing or its circuit breaker is open. It is ignored when a router is configured, as
+// the routes name their own fallbacks.
+func WithFallback(upstream string) Option {
+	return func(p *Proxy) {
+		p.fallbackURL = upstream
+	}
+}
+
+// New creates a proxy that forwards requests to the upstream base url, e.g.
+// http://pedrogpt:8080, and records metrics with the given client.
+func New(upstream string, client *metrics.Client, opts ...Option) (*Proxy, error) {
+	target, err := parseUpstreamURL(upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		client:     client,
+		identifier: middleware.NewClientIdentifier(nil),
+		retry:      DefaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.router == nil {
+		if p.router, err = p.defaultRouter(target); err != nil {
+			return nil, err
+		}
+	}
+
+	p.mw = middleware.NewOpenAIMiddleware(middleware.WithClientIdentifier(p.identifier))
+	base := p.retry.transport()
+	p.transports = make(map[string]http.RoundTripper)
+	p.breakers = make(map[string]*breaker)
+	for _, u := range p.router.Upstreams() {
+		name := u.Name
+		p.breakers[name] = newBreaker(p.retry.BreakerFailures, p.retry.BreakerCooldown,
+			func(state BreakerState) { client.SetCircuitState(name, int(state)) })
+		p.transports[name] = p.mw.NewTransport(base,
+			middleware.RecorderFunc(func(m *types.ResponseMetrics) {
+				m.Upstream = name
+				p.client.RecordMetrics(m)
+			}))
+	}
+	p.reverseProxy = &httputil.ReverseProxy{
+		Rewrite:        p.rewrite,
+		Transport:      roundTripperFunc(p.roundTrip),
+		ModifyResponse: p.modifyResponse,
+		ErrorHandler:   p.handleError,
+	}
+
+	if p.quota != nil {
+		now := time.Now()
+		for _, name := range p.quota.Clients() {
+			p.setBudgetGauges(name, p.quota.Remaining(name, now))
+		}
+	}
+	return p, nil
+}
+
+// defaultRouter routes every model to the upstream passed to New, failing over to the
+// upstream passed to WithFallback. Its catch-all route matches without comparing names.
+func (p *Proxy) defaultRouter(target *url.URL) (*Router, error) {
+	upstreams := []*Upstream{{Name: DefaultUpstream, URL: target}}
+	route := Route{Model: "*", Upstream: DefaultUpstream}
+	if p.fallbackURL != "" {
+		fallback, err := parseUpstreamURL(p.fallbackURL)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, &Upstream{Name: FallbackUpstream, URL: fallback})
+		route.Fallback = FallbackUpstream
+	}
+	return NewRouter(upstreams, []Route{route}, nil)
+}
+
+// Handler returns the http.Handler that serves the proxied OpenAI endpoints.
+func (p *Proxy) Handler() http.Handler {
+	handler := p.admit(p.reverseProxy)
+	mux := http.NewServeMux()
+	mux.Handle("POST /v1/chat/completions", handler)
+	mux.Handle("POST /v1/completions", handler)
+	mux.Handle("POST /v1/embeddings", handler)
+	return mux
+}
+
+// rewrite sets the X-Forwarded headers of the outgoing request. roundTrip points it at each
+// upstream it is sent to.
+func (p *Proxy) rewrite(r *httputil.ProxyRequest) {
+	r.SetXForwarded()
+}
+
+// roundTripperFunc adapts a function to the http.RoundTripper interface.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// modifyResponse drops the upstream's rate limit headers when the proxy sets its own.
+func (p *Proxy) modifyResponse(resp *http.Response) error {
+	if p.limiter == nil {
+		return nil
+	}
+	for name := range resp.Header {
+		if strings.HasPrefix(name, "X-Ratelimit-") {
+			resp.Header.Del(name)
+		}
+	}
+	return nil
+}
+
+// charge charges tokens to the account's budget.
+func (p *Proxy) charge(account string, tokens int64) {
+	p.setBudgetGauges(account, p.quota.Add(account, tokens, time.Now()))
+}
+
+// Close saves the budget usage that has not been saved yet. It should be called once the
+// server has shut down.
+func (p *Proxy) Close() error {
+	if p.quota == nil {
+		return nil
+	}
+	return p.quota.Flush()
+}
+
+func (p *Proxy) setBudgetGauges(client string, remaining quota.Remaining) {
+	p.client.SetBudgetRemaining(client, quota.PeriodDay, remaining.Daily)
+	p.client.SetBudgetRemaining(client, quota.PeriodMonth, remaining.Monthly)
+}
+
+// handleError is called when no upstream of the request can be reached.
+func (p *Proxy) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("proxy error for %s %s: %v", r.Method, r.URL.Path, err)
+	if errors.Is(err, errBreakersOpen) {
+		writeError(w, http.StatusServiceUnavailable, "api_error", "upstream_unavailable", err.Error())
+		return
+	}
+	writeError(w, http.StatusBadGateway, "api_error", "upstream_error",
+		fmt.Sprintf("the upstream could not be reached: %v", err))
+}
@@ -0,0 +1,248 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/soypete/pedro-ops/internal/metrics"
+	"github.com/soypete/pedro-ops/internal/middleware"
+	"github.com/soypete/pedro-ops/internal/quota"
+	"github.com/soypete/pedro-ops/types"
+)
+
+const completion = `{"id":"chatcmpl-1","object":"chat.completion","model":"gpt-oss-20b",` +
+	`"choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}],` +
+	`"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`
+
+const chatRequest = `{"model":"gpt-oss-20b","messages":[{"role":"user","content":"hello"}]}`
+
+// testPolicy retries without waiting, so the tests do not sleep.
+var testPolicy = RetryPolicy{
+	Retries:         1,
+	Backoff:         time.Millisecond,
+	MaxBackoff:      time.Millisecond,
+	ConnectTimeout:  time.Second,
+	BreakerFailures: 2,
+	BreakerCooldown: time.Minute,
+}
+
+func newTestProxy(t *testing.T, upstream string, opts ...Option) *httptest.Server {
+	t.Helper()
+	opts = append([]Option{WithRetryPolicy(testPolicy)}, opts...)
+	p, err := New(upstream, metrics.NewClient(), opts...)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	srv := httptest.NewServer(p.Handler())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func writeCompletion(t *testing.T, w http.ResponseWriter) {
+	t.Helper()
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := io.WriteString(w, completion); err != nil {
+		t.Errorf("write response: %v", err)
+	}
+}
+
+func postChat(t *testing.T, srv *httptest.Server, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodPost, srv.URL+"/v1/chat/completions",
+		strings.NewReader(chatRequest))
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	for name := range header {
+		req.Header.Set(name, header.Get(name))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	return resp, body
+}
+
+func TestProxyRoundTrip(t *testing.T) {
+	var got struct {
+		path, body string
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read request: %v", err)
+		}
+		got.path, got.body = r.URL.Path, string(body)
+		writeCompletion(t, w)
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name     string
+		upstream string
+	}{
+		{name: "no path", upstream: upstream.URL},
+		{name: "root path", upstream: upstream.URL + "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestProxy(t, tt.upstream)
+			resp, body := postChat(t, srv, nil)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, body %s", resp.StatusCode, body)
+			}
+			if string(body) != completion {
+				t.Errorf("body = %s, want the upstream's response", body)
+			}
+			if got.path != "/v1/chat/completions" {
+				t.Errorf("upstream path = %q, want /v1/chat/completions", got.path)
+			}
+			if got.body != chatRequest {
+				t.Errorf("upstream body = %s, want %s", got.body, chatRequest)
+			}
+		})
+	}
+}
+
+func TestProxyFailover(t *testing.T) {
+	var primaryCalls atomic.Int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryCalls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeCompletion(t, w)
+	}))
+	defer fallback.Close()
+
+	srv := newTestProxy(t, primary.URL, WithFallback(fallback.URL))
+	for i := range 3 {
+		resp, body := postChat(t, srv, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status = %d, body %s", i, resp.StatusCode, body)
+		}
+	}
+	// the first request and its retry open the primary's breaker, so later requests skip it.
+	if n := primaryCalls.Load(); n != 2 {
+		t.Errorf("primary got %d requests, want 2", n)
+	}
+}
+
+func TestProxyFailoverConnectionRefused(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeCompletion(t, w)
+	}))
+	defer fallback.Close()
+
+	srv := newTestProxy(t, down.URL, WithFallback(fallback.URL))
+	resp, body := postChat(t, srv, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body %s", resp.StatusCode, body)
+	}
+}
+
+func TestProxySlowCompletion(t *testing.T) {
+	var calls atomic.Int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		writeCompletion(t, w)
+	}))
+	defer slow.Close()
+
+	// a non-streamed completion sends its headers only when generation is done, which must
+	// not be mistaken for a hung upstream.
+	policy := testPolicy
+	policy.ConnectTimeout = 50 * time.Millisecond
+	srv := newTestProxy(t, slow.URL, WithRetryPolicy(policy))
+	resp, body := postChat(t, srv, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body %s", resp.StatusCode, body)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("upstream got %d requests, want 1", n)
+	}
+}
+
+func TestProxyUpstreamTimeout(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+	}))
+	defer hung.Close()
+	defer close(release)
+
+	policy := testPolicy
+	policy.Timeout = 50 * time.Millisecond
+	srv := newTestProxy(t, hung.URL, WithRetryPolicy(policy))
+
+	// timed out requests reached the upstream, so they are not retried, but they still open
+	// its breaker.
+	for i, want := range []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusServiceUnavailable} {
+		resp, body := postChat(t, srv, nil)
+		if resp.StatusCode != want {
+			t.Fatalf("request %d: status = %d, want %d", i, resp.StatusCode, want)
+		}
+		var errResp types.ErrorResponse
+		if err := json.Unmarshal(body, &errResp); err != nil || errResp.Error == nil {
+			t.Fatalf("request %d: body %s is not an error envelope: %v", i, body, err)
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("upstream got %d requests, want 2", n)
+	}
+}
+
+func TestProxyBudgetAccounts(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeCompletion(t, w)
+	}))
+	defer upstream.Close()
+
+	budgets, err := quota.ParseBudgets("default=4/,batch=4/")
+	if err != nil {
+		t.Fatalf("ParseBudgets: %v", err)
+	}
+	tracker, err := quota.NewTracker(budgets, "")
+	if err != nil {
+		t.Fatalf("NewTracker: %v", err)
+	}
+	tokens := map[string]string{"sk-batch": "batch"}
+	srv := newTestProxy(t, upstream.URL, WithQuota(tracker),
+		WithClientIdentifier(middleware.NewClientIdentifier(tokens)))
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   int
+	}{
+		{"first anonymous request", http.Header{}, http.StatusOK},
+		{"renamed anonymous client", http.Header{"X-Client-Name": {"other"}}, http.StatusTooManyRequests},
+		{"client named after another", http.Header{"X-Client-Name": {"batch"}}, http.StatusTooManyRequests},
+		{"authenticated client", http.Header{"Authorization": {"Bearer sk-batch"}}, http.StatusOK},
+		{"exhausted authenticated client", http.Header{"Authorization": {"Bearer sk-batch"}}, http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		resp, body := postChat(t, srv, tt.header)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status = %d, want %d, body %s", tt.name, resp.StatusCode, tt.want, body)
+		}
+	}
+}
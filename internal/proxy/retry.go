@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Retry reasons, used as the reason metric label.
+const (
+	retryError    = "error"
+	retryStatus   = "status"
+	retryFailover = "failover"
+)
+
+// errBreakersOpen is returned when the circuit breakers of every upstream of a request are open.
+var errBreakersOpen = errors.New("no upstream available, every circuit breaker is open")
+
+// RetryPolicy configures how failed upstream requests are retried and when an upstream's
+// circuit breaker opens.
+type RetryPolicy struct {
+	// Retries is the number of times a request is retried on the same upstream before failing
+	// over to the fallback.
+	Retries int
+	// Backoff is the delay before the first retry, doubled for every further retry up to
+	// MaxBackoff, with up to 50% jitter.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// ConnectTimeout bounds how long an attempt waits to connect to the upstream, and Timeout
+	// how long it then waits for the response headers. A non-streamed completion sends its
+	// headers only once generation is done, so Timeout is off when zero and must otherwise be
+	// longer than the longest generation. Bodies are not limited.
+	ConnectTimeout time.Duration
+	Timeout        time.Duration
+	// BreakerFailures is the number of consecutive failures that open an upstream's circuit
+	// breaker, and BreakerCooldown how long it stays open before a probe request is let through.
+	BreakerFailures int
+	BreakerCooldown time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy used unless WithRetryPolicy is given.
+var DefaultRetryPolicy = RetryPolicy{
+	Retries:         2,
+	Backoff:         250 * time.Millisecond,
+	MaxBackoff:      2 * time.Second,
+	ConnectTimeout:  5 * time.Second,
+	BreakerFailures: 5,
+	BreakerCooldown: 30 * time.Second,
+}
+
+// transport returns the transport upstream attempts are sent with, which fails attempts that
+// exceed the timeouts so they count against the upstream's circuit breaker.
+func (rp RetryPolicy) transport() http.RoundTripper {
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: rp.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   rp.ConnectTimeout,
+		ExpectContinueTimeout: time.Second,
+		ResponseHeaderTimeout: rp.Timeout,
+	}
+}
+
+// backoff returns the delay before the given retry, starting at 1.
+func (rp RetryPolicy) backoff(retry int) time.Duration {
+	d := rp.Backoff << (retry - 1)
+	if d > rp.MaxBackoff || d <= 0 {
+		d = rp.MaxBackoff
+	}
+	// #nosec G404 -- jitter does not need a cryptographic random source.
+	return d/2 + rand.N(d/2+1)
+}
+
+// routing is the upstreams and body of a request, stored in its context by admit.
+type routing struct {
+	upstreams []*Upstream
+	body      []byte
+}
+
+type routingKey struct{}
+
+func withRouting(ctx context.Context, rt *routing) context.Context {
+	return context.WithValue(ctx, routingKey{}, rt)
+}
+
+func routingFrom(ctx context.Context) *routing {
+	if rt, ok := ctx.Value(routingKey{}).(*routing); ok {
+		return rt
+	}
+	return &routing{}
+}
+
+// roundTrip sends the request to its primary upstream and retries connection errors and
+// 502, 503 and 504 responses with backoff, failing over to the fallback upstream once the
+// retries are used up or the primary's circuit breaker is open. Requests that fail after
+// reaching the upstream are not retried, as the upstream may still be generating them.
+func (p *Proxy) roundTrip(req *http.Request) (*http.Response, error) {
+	rt := routingFrom(req.Context())
+	var resp *http.Response
+	var err error
+	for i, u := range rt.upstreams {
+		for attempt := 0; attempt <= p.retry.Retries; attempt++ {
+			if attempt > 0 && !sleep(req.Context(), p.retry.backoff(attempt)) {
+				return resp, err
+			}
+			if !p.breakers[u.Name].allow(time.Now()) {
+				break
+			}
+			switch {
+			case attempt > 0:
+				p.client.RecordRetry(u.Name, retryReason(err))
+			case i > 0:
+				p.client.RecordRetry(u.Name, retryFailover)
+			}
+			if resp != nil {
+				discard(resp)
+			}
+			resp, err = p.send(req, u, rt.body)
+			if !shouldRetry(resp, err) || req.Context().Err() != nil {
+				return resp, err
+			}
+		}
+	}
+	if resp == nil && err == nil {
+		err = errBreakersOpen
+	}
+	return resp, err
+}
+
+// send sends the request to u and updates the circuit breaker of u with the outcome.
+func (p *Proxy) send(req *http.Request, u *Upstream, body []byte) (*http.Response, error) {
+	b := p.breakers[u.Name]
+	resp, err := p.transports[u.Name].RoundTrip(upstreamRequest(req, u, body))
+	switch {
+	case req.Context().Err() != nil:
+		b.release()
+	case err != nil || resp.StatusCode >= http.StatusInternalServerError:
+		b.failure(time.Now())
+	default:
+		b.success()
+	}
+	return resp, err
+}
+
+// upstreamRequest returns a copy of the outgoing request sent to u with a fresh body. The
+// upstream's api key replaces the caller's credentials when it has one.
+func upstreamRequest(req *http.Request, u *Upstream, body []byte) *http.Request {
+	out := req.Clone(req.Context())
+	out.URL = upstreamURL(u.URL, req.URL)
+	out.Host = ""
+	if u.APIKey != "" {
+		out.Header.Set("Authorization", "Bearer "+u.APIKey)
+	}
+	out.ContentLength = int64(len(body))
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	out.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return out
+}
+
+// upstreamURL returns the url of the upstream base for the request url, joining their paths
+// and queries like httputil.ProxyRequest.SetURL.
+func upstreamURL(base, req *url.URL) *url.URL {
+	target := *base
+	target.Path = strings.TrimSuffix(base.Path, "/") + "/" + strings.TrimPrefix(req.Path, "/")
+	target.RawPath = ""
+	switch {
+	case base.RawQuery == "":
+		target.RawQuery = req.RawQuery
+	case req.RawQuery != "":
+		target.RawQuery = base.RawQuery + "&" + req.RawQuery
+	}
+	return &target
+}
+
+// shouldRetry reports whether an attempt failed without the upstream processing the request:
+// it could not be sent, or the upstream answered that it is unavailable.
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return unsent(err)
+	}
+	return retryable(resp.StatusCode)
+}
+
+// unsent reports whether err happened before the request was written to the upstream, when
+// connecting to it or to the proxy in front of it.
+func unsent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect")
+}
+
+// retryable reports whether a response status means the upstream is unavailable.
+func retryable(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+func retryReason(err error) string {
+	if err != nil {
+		return retryError
+	}
+	return retryStatus
+}
+
+// discard reads and closes the body of a response that is not returned, so its metrics are
+// recorded and the connection can be reused.
+func discard(resp *http.Response) {
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		log.Printf("discard response of failed attempt: %v", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		log.Printf("close response of failed attempt: %v", err)
+	}
+}
+
+// sleep waits for d and reports false when ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
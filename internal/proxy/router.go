@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Names of the upstreams configured with New and WithFallback, which serve every model unless
+// a Router is configured.
+const (
+	DefaultUpstream  = "default"
+	FallbackUpstream = "fallback"
+)
+
+// Upstream is an OpenAI compatible server that requests are routed to.
+type Upstream struct {
+	Name string
+	URL  *url.URL
+	// APIKey replaces the caller's bearer token when set, e.g. for api.openai.com.
+	APIKey string
+}
+
+// Route sends requests for the models matching Model, a pattern such as "Qwen3*" in which *
+// matches any characters including the / of names like "Qwen/Qwen3-Coder-30B", to the named
+// upstream, failing over to the Fallback upstream if it is set.
+type Route struct {
+	Model    string `json:"model"`
+	Upstream string `json:"upstream"`
+	Fallback string `json:"fallback,omitempty"`
+}
+
+// Router picks the upstream of a request by its model. Aliases are resolved before the routes
+// are matched in order, and the request is sent with the resolved model name.
+type Router struct {
+	upstreams map[string]*Upstream
+	aliases   map[string]string
+	routes    []Route
+}
+
+// NewRouter creates a router for the upstreams. Every route must name one of the upstreams.
+func NewRouter(upstreams []*Upstream, routes []Route, aliases map[string]string) (*Router, error) {
+	rt := &Router{
+		upstreams: make(map[string]*Upstream, len(upstreams)),
+		aliases:   aliases,
+		routes:    routes,
+	}
+	for _, u := range upstreams {
+		rt.upstreams[u.Name] = u
+	}
+	for _, route := range routes {
+		if _, ok := rt.upstreams[route.Upstream]; !ok {
+			return nil, fmt.Errorf("route %q: unknown upstream %q", route.Model, route.Upstream)
+		}
+		if _, ok := rt.upstreams[route.Fallback]; route.Fallback != "" && !ok {
+			return nil, fmt.Errorf("route %q: unknown fallback upstream %q", route.Model, route.Fallback)
+		}
+	}
+	return rt, nil
+}
+
+// routerConfig is the json form of a Router.
+type routerConfig struct {
+	Upstreams map[string]struct {
+		URL    string `json:"url"`
+		APIKey string `json:"api_key"`
+		// APIKeyEnv names the environment variable holding the api key, so the file
+		// does not have to contain it.
+		APIKeyEnv string `json:"api_key_env"`
+	} `json:"upstreams"`
+	Aliases map[string]string `json:"aliases"`
+	Routes  []Route           `json:"routes"`
+}
+
+// LoadRouter reads a router from a json file, e.g.
+//
+//	{
+//	  "upstreams": {
+//	    "pedrogpt": {"url": "http://pedrogpt:8080"},
+//	    "openai": {"url": "https://api.openai.com", "api_key_env": "OPENAI_API_KEY"}
+//	  },
+//	  "aliases": {"qwen-coder": "Qwen3-Coder-30B-A3B-Instruct"},
+//	  "routes": [
+//	    {"model": "gpt-oss-*", "upstream": "pedrogpt", "fallback": "openai"},
+//	    {"model": "Qwen3*", "upstream": "pedrogpt"},
+//	    {"model": "*", "upstream": "openai"}
+//	  ]
+//	}
+func LoadRouter(file string) (*Router, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read routes: %w", err)
+	}
+	var cfg routerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("decode routes %s: %w", file, err)
+	}
+
+	upstreams := make([]*Upstream, 0, len(cfg.Upstreams))
+	for name, u := range cfg.Upstreams {
+		target, err := parseUpstreamURL(u.URL)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", name, err)
+		}
+		apiKey := u.APIKey
+		if u.APIKeyEnv != "" {
+			apiKey = os.Getenv(u.APIKeyEnv)
+		}
+		upstreams = append(upstreams, &Upstream{Name: name, URL: target, APIKey: apiKey})
+	}
+	return NewRouter(upstreams, cfg.Routes, cfg.Aliases)
+}
+
+// Route returns the upstreams that serve model, the primary followed by the fallback if the
+// route has one, and the model name to request from them.
+func (rt *Router) Route(model string) ([]*Upstream, string, bool) {
+	if alias, ok := rt.aliases[model]; ok {
+		model = alias
+	}
+	for _, route := range rt.routes {
+		if !matchModel(route.Model, model) {
+			continue
+		}
+		upstreams := []*Upstream{rt.upstreams[route.Upstream]}
+		if route.Fallback != "" {
+			upstreams = append(upstreams, rt.upstreams[route.Fallback])
+		}
+		return upstreams, model, true
+	}
+	return nil, model, false
+}
+
+// matchModel reports whether model matches the route pattern, where * matches any characters
+// and the rest must match exactly.
+func matchModel(pattern, model string) bool {
+	if pattern == "*" {
+		return true
+	}
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == model
+	}
+	prefix, suffix := parts[0], parts[len(parts)-1]
+	if len(model) < len(prefix)+len(suffix) || !strings.HasPrefix(model, prefix) ||
+		!strings.HasSuffix(model, suffix) {
+		return false
+	}
+	// match the middle parts leftmost first between the prefix and suffix.
+	model = model[len(prefix) : len(model)-len(suffix)]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(model, part)
+		if i < 0 {
+			return false
+		}
+		model = model[i+len(part):]
+	}
+	return true
+}
+
+// Upstreams returns every upstream of the router.
+func (rt *Router) Upstreams() []*Upstream {
+	upstreams := make([]*Upstream, 0, len(rt.upstreams))
+	for _, u := range rt.upstreams {
+		upstreams = append(upstreams, u)
+	}
+	return upstreams
+}
+
+// parseUpstreamURL parses the base url of an upstream, e.g. http://pedrogpt:8080.
+func parseUpstreamURL(upstream string) (*url.URL, error) {
+	target, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("parse upstream url: %w", err)
+	}
+	if target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("upstream url %q must include a scheme and host", upstream)
+	}
+	return target, nil
+}
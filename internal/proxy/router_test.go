@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestMatchModel(t *testing.T) {
+	tests := []struct {
+		pattern, model string
+		want           bool
+	}{
+		{"*", "", true},
+		{"*", "Qwen/Qwen3-Coder-30B", true},
+		{"gpt-oss-20b", "gpt-oss-20b", true},
+		{"gpt-oss-20b", "gpt-oss-120b", false},
+		{"gpt-oss-*", "gpt-oss-20b", true},
+		{"gpt-oss-*", "gpt-4o", false},
+		{"Qwen/*", "Qwen/Qwen3-Coder-30B", true},
+		{"*/Qwen3*", "Qwen/Qwen3-Coder-30B", true},
+		{"*Coder*", "Qwen/Qwen3-Coder-30B", true},
+		{"*-30B", "Qwen/Qwen3-Coder-30B", true},
+		{"*-30B", "Qwen/Qwen3-Coder-30B-GGUF", false},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "acb", false},
+		{"ab*ba", "aba", false},
+		{"[abc]*", "a", false},
+	}
+	for _, tt := range tests {
+		if got := matchModel(tt.pattern, tt.model); got != tt.want {
+			t.Errorf("matchModel(%q, %q) = %v, want %v", tt.pattern, tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	local := &Upstream{Name: "local", URL: &url.URL{Scheme: "http", Host: "local:8080"}}
+	openai := &Upstream{Name: "openai", URL: &url.URL{Scheme: "https", Host: "api.openai.com"}}
+	rt, err := NewRouter([]*Upstream{local, openai}, []Route{
+		{Model: "gpt-oss-*", Upstream: "local", Fallback: "openai"},
+		{Model: "Qwen/*", Upstream: "local"},
+		{Model: "gpt-*", Upstream: "openai"},
+	}, map[string]string{"coder": "Qwen/Qwen3-Coder-30B"})
+	if err != nil {
+		t.Fatalf("NewRouter: %v", err)
+	}
+
+	tests := []struct {
+		model     string
+		upstreams []string
+		resolved  string
+	}{
+		{"gpt-oss-20b", []string{"local", "openai"}, "gpt-oss-20b"},
+		{"Qwen/Qwen3-Coder-30B", []string{"local"}, "Qwen/Qwen3-Coder-30B"},
+		{"coder", []string{"local"}, "Qwen/Qwen3-Coder-30B"},
+		{"gpt-4o", []string{"openai"}, "gpt-4o"},
+		{"llama-3", nil, "llama-3"},
+	}
+	for _, tt := range tests {
+		upstreams, resolved, ok := rt.Route(tt.model)
+		var names []string
+		for _, u := range upstreams {
+			names = append(names, u.Name)
+		}
+		if !slices.Equal(names, tt.upstreams) || resolved != tt.resolved || ok != (tt.upstreams != nil) {
+			t.Errorf("Route(%q) = %v, %q, %v, want %v, %q", tt.model, names, resolved, ok,
+				tt.upstreams, tt.resolved)
+		}
+	}
+}
+
+func TestNewRouterUnknownUpstream(t *testing.T) {
+	local := &Upstream{Name: "local", URL: &url.URL{Scheme: "http", Host: "local:8080"}}
+	tests := []struct {
+		name  string
+		route Route
+	}{
+		{"upstream", Route{Model: "*", Upstream: "remote"}},
+		{"fallback", Route{Model: "*", Upstream: "local", Fallback: "remote"}},
+	}
+	for _, tt := range tests {
+		if _, err := NewRouter([]*Upstream{local}, []Route{tt.route}, nil); err == nil {
+			t.Errorf("%s: NewRouter accepted an unknown upstream", tt.name)
+		}
+	}
+}
+
+func TestDefaultRouter(t *testing.T) {
+	p := &Proxy{fallbackURL: "http://fallback:8080"}
+	rt, err := p.defaultRouter(&url.URL{Scheme: "http", Host: "pedrogpt:8080"})
+	if err != nil {
+		t.Fatalf("defaultRouter: %v", err)
+	}
+	for _, model := range []string{"gpt-oss-20b", "Qwen/Qwen3-Coder-30B", ""} {
+		upstreams, _, ok := rt.Route(model)
+		if !ok || len(upstreams) != 2 || upstreams[0].Name != DefaultUpstream ||
+			upstreams[1].Name != FallbackUpstream {
+			t.Errorf("Route(%q) = %v, %v, want the default and fallback upstreams", model, upstreams, ok)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// package quota tracks the tokens each client uses per day and month against its budget.
+package quota
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Periods a budget applies to, used as the period metric label.
+const (
+	PeriodDay   = "day"
+	PeriodMonth = "month"
+)
+
+// DefaultClient is the name used in a budget spec for the budget of clients without their own.
+const DefaultClient = "default"
+
+// Budget is the number of tokens a client may use per UTC day and month. Zero means unlimited.
+type Budget struct {
+	Daily   int64
+	Monthly int64
+}
+
+// Budgets holds the budget of each client and the default for clients without one.
+type Budgets struct {
+	Default Budget
+	Clients map[string]Budget
+}
+
+// For returns the budget of the named client.
+func (b Budgets) For(client string) Budget {
+	if budget, ok := b.Clients[client]; ok {
+		return budget
+	}
+	return b.Default
+}
+
+// ParseBudgets parses a comma separated list of name=daily/monthly budgets, e.g.
+// "default=200000/5000000,eleduck-analytics=1000000/20000000". Either limit may be empty or 0
+// for no limit, e.g. "twitch-bot=/1000000".
+func ParseBudgets(s string) (Budgets, error) {
+	budgets := Budgets{Clients: make(map[string]Budget)}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, limits, ok := strings.Cut(entry, "=")
+		daily, monthly, okLimits := strings.Cut(limits, "/")
+		if !ok || !okLimits || name == "" {
+			return Budgets{}, fmt.Errorf("budget %q must be name=daily/monthly", entry)
+		}
+		var budget Budget
+		var err error
+		if budget.Daily, err = parseLimit(daily); err != nil {
+			return Budgets{}, fmt.Errorf("daily budget of %s: %w", name, err)
+		}
+		if budget.Monthly, err = parseLimit(monthly); err != nil {
+			return Budgets{}, fmt.Errorf("monthly budget of %s: %w", name, err)
+		}
+		if name == DefaultClient {
+			budgets.Default = budget
+		} else {
+			budgets.Clients[name] = budget
+		}
+	}
+	return budgets, nil
+}
+
+func parseLimit(s string) (int64, error) {
+	if s = strings.TrimSpace(s); s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid token limit %q", s)
+	}
+	return n, nil
+}
+
+// Usage is the tokens a client used in the current day and month.
+type Usage struct {
+	Day         string `json:"day"`
+	DayTokens   int64  `json:"day_tokens"`
+	Month       string `json:"month"`
+	MonthTokens int64  `json:"month_tokens"`
+}
+
+// roll resets the counters whose period has ended by now.
+func (u *Usage) roll(now time.Time) {
+	now = now.UTC()
+	if day := now.Format(time.DateOnly); u.Day != day {
+		u.Day, u.DayTokens = day, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthTokens = month, 0
+	}
+}
+
+// Remaining is the number of tokens a client has left. A negative value means no limit.
+type Remaining struct {
+	Daily   int64
+	Monthly int64
+}
+
+// Exhausted reports whether either budget has no tokens left.
+func (r Remaining) Exhausted() bool {
+	return r.Daily == 0 || r.Monthly == 0
+}
+
+// saveInterval is the least time between two saves of the state file.
+const saveInterval = 5 * time.Second
+
+// Tracker counts the tokens used by each client against their budgets. When created with a
+// state file the counters are saved in the background at most every few seconds and by Flush,
+// so they survive restarts. Clients are tracked until their month ends, so they should be
+// authenticated names rather than self reported ones.
+type Tracker struct {
+	budgets Budgets
+	store   *fileStore
+
+	mu    sync.Mutex
+	usage map[string]*Usage
+	// seq counts the updates of usage and savedSeq is the last update written to the state
+	// file. savedAt is when the last save was started, successful or not.
+	seq      uint64
+	savedSeq uint64
+	savedAt  time.Time
+
+	// saveMu serializes writes of the state file, which are made without holding mu, and
+	// saving is set while a background save runs.
+	saveMu sync.Mutex
+	saving atomic.Bool
+}
+
+// NewTracker creates a tracker for the budgets. If statePath is not empty the counters are
+// loaded from and saved to that file.
+func NewTracker(budgets Budgets, statePath string) (*Tracker, error) {
+	t := &Tracker{
+		budgets: budgets,
+		usage:   make(map[string]*Usage),
+	}
+	if statePath != "" {
+		t.store = &fileStore{path: statePath}
+		usage, err := t.store.load()
+		if err != nil {
+			return nil, err
+		}
+		t.usage = usage
+	}
+	return t, nil
+}
+
+// Clients returns the names of the clients that have their own budget.
+func (t *Tracker) Clients() []string {
+	clients := make([]string, 0, len(t.budgets.Clients))
+	for name := range t.budgets.Clients {
+		clients = append(clients, name)
+	}
+	return clients
+}
+
+// Remaining returns the tokens the client has left at now.
+func (t *Tracker) Remaining(client string, now time.Time) Remaining {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.remaining(client, now)
+}
+
+// Add charges tokens to the client's budget and returns the tokens left. The counters are
+// saved by a background goroutine, so a failed save is logged and retried by the next save.
+func (t *Tracker) Add(client string, tokens int64, now time.Time) Remaining {
+	t.mu.Lock()
+	u := t.clientUsage(client, now)
+	u.DayTokens += tokens
+	u.MonthTokens += tokens
+	t.seq++
+	remaining := t.remaining(client, now)
+	due := now.Sub(t.savedAt) >= saveInterval
+	if due {
+		t.prune(now)
+		t.savedAt = now
+	}
+	t.mu.Unlock()
+
+	if due && t.store != nil && t.saving.CompareAndSwap(false, true) {
+		go func() {
+			defer t.saving.Store(false)
+			if err := t.Flush(); err != nil {
+				log.Printf("quota: %v", err)
+			}
+		}()
+	}
+	return remaining
+}
+
+// Flush saves the counters that changed since they were last saved to the state file.
+func (t *Tracker) Flush() error {
+	if t.store == nil {
+		return nil
+	}
+	t.mu.Lock()
+	if t.savedSeq == t.seq {
+		t.mu.Unlock()
+		return nil
+	}
+	t.prune(time.Now())
+	usage := make(map[string]Usage, len(t.usage))
+	for client, u := range t.usage {
+		usage[client] = *u
+	}
+	seq := t.seq
+	t.mu.Unlock()
+	return t.save(usage, seq)
+}
+
+// prune drops the clients that used no tokens in the current month, so the tracker does not
+// grow with every client ever seen. t.mu must be held.
+func (t *Tracker) prune(now time.Time) {
+	for client, u := range t.usage {
+		u.roll(now)
+		if u.MonthTokens == 0 {
+			delete(t.usage, client)
+		}
+	}
+}
+
+// save writes the counters as of update seq, unless a later update was already written. The
+// update only counts as saved once the write succeeded, so a failed write is retried.
+func (t *Tracker) save(usage map[string]Usage, seq uint64) error {
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+	t.mu.Lock()
+	stale := seq <= t.savedSeq
+	t.mu.Unlock()
+	if stale {
+		return nil
+	}
+	if err := t.store.save(usage); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.savedSeq = seq
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *Tracker) remaining(client string, now time.Time) Remaining {
+	budget := t.budgets.For(client)
+	u := t.clientUsage(client, now)
+	return Remaining{
+		Daily:   left(budget.Daily, u.DayTokens),
+		Monthly: left(budget.Monthly, u.MonthTokens),
+	}
+}
+
+func (t *Tracker) clientUsage(client string, now time.Time) *Usage {
+	u, ok := t.usage[client]
+	if !ok {
+		u = &Usage{}
+		t.usage[client] = u
+	}
+	u.roll(now)
+	return u
+}
+
+// left returns the tokens left of limit, or -1 when there is no limit.
+func left(limit, used int64) int64 {
+	if limit == 0 {
+		return -1
+	}
+	return max(limit-used, 0)
+}
@@ -0,0 +1,159 @@
+package quota
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUsageRoll(t *testing.T) {
+	base := Usage{Day: "2025-01-31", DayTokens: 10, Month: "2025-01", MonthTokens: 100}
+	tests := []struct {
+		name string
+		now  time.Time
+		want Usage
+	}{
+		{
+			name: "same day",
+			now:  time.Date(2025, 1, 31, 23, 59, 0, 0, time.UTC),
+			want: base,
+		},
+		{
+			name: "next day",
+			now:  time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC),
+			want: Usage{Day: "2025-02-01", Month: "2025-02"},
+		},
+		{
+			name: "rolls over in UTC",
+			now:  time.Date(2025, 1, 31, 20, 0, 0, 0, time.FixedZone("UTC-5", -5*60*60)),
+			want: Usage{Day: "2025-02-01", Month: "2025-02"},
+		},
+	}
+	for _, tt := range tests {
+		u := base
+		u.roll(tt.now)
+		if u != tt.want {
+			t.Errorf("%s: roll = %+v, want %+v", tt.name, u, tt.want)
+		}
+	}
+
+	u := Usage{Day: "2025-01-30", DayTokens: 10, Month: "2025-01", MonthTokens: 100}
+	u.roll(time.Date(2025, 1, 31, 1, 0, 0, 0, time.UTC))
+	if want := (Usage{Day: "2025-01-31", Month: "2025-01", MonthTokens: 100}); u != want {
+		t.Errorf("roll to the next day = %+v, want %+v", u, want)
+	}
+}
+
+func TestParseBudgets(t *testing.T) {
+	budgets, err := ParseBudgets("default=200/5000, batch=/1000")
+	if err != nil {
+		t.Fatalf("ParseBudgets: %v", err)
+	}
+	if got := budgets.For("someone"); got != (Budget{Daily: 200, Monthly: 5000}) {
+		t.Errorf("For(someone) = %+v", got)
+	}
+	if got := budgets.For("batch"); got != (Budget{Monthly: 1000}) {
+		t.Errorf("For(batch) = %+v", got)
+	}
+	for _, spec := range []string{"batch=1", "=1/1", "batch=-1/1"} {
+		if _, err := ParseBudgets(spec); err == nil {
+			t.Errorf("ParseBudgets(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestTracker(t *testing.T) {
+	now := time.Date(2025, 1, 31, 12, 0, 0, 0, time.UTC)
+	budgets := Budgets{Default: Budget{Daily: 100}, Clients: map[string]Budget{"batch": {Monthly: 150}}}
+	tr, err := NewTracker(budgets, "")
+	if err != nil {
+		t.Fatalf("NewTracker: %v", err)
+	}
+
+	steps := []struct {
+		client    string
+		tokens    int64
+		at        time.Time
+		want      Remaining
+		exhausted bool
+	}{
+		{"a", 60, now, Remaining{Daily: 40, Monthly: -1}, false},
+		{"a", 60, now, Remaining{Daily: 0, Monthly: -1}, true},
+		{"a", 10, now.Add(12 * time.Hour), Remaining{Daily: 90, Monthly: -1}, false},
+		{"batch", 100, now, Remaining{Daily: -1, Monthly: 50}, false},
+		// twelve hours later is the first of February, so the monthly budget starts over.
+		{"batch", 100, now.Add(12 * time.Hour), Remaining{Daily: -1, Monthly: 50}, false},
+	}
+	for i, s := range steps {
+		got := tr.Add(s.client, s.tokens, s.at)
+		if got != s.want {
+			t.Errorf("step %d: remaining of %s = %+v, want %+v", i, s.client, got, s.want)
+		}
+		if got.Exhausted() != s.exhausted {
+			t.Errorf("step %d: Exhausted() = %v, want %v", i, got.Exhausted(), s.exhausted)
+		}
+	}
+}
+
+func TestTrackerState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "budgets.json")
+	budgets := Budgets{Default: Budget{Daily: 100}}
+	now := time.Now()
+
+	tr, err := NewTracker(budgets, path)
+	if err != nil {
+		t.Fatalf("NewTracker: %v", err)
+	}
+	for _, client := range []string{"a", "a", "b"} {
+		tr.Add(client, 30, now)
+	}
+	tr.Remaining("never-charged", now)
+	if err := tr.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	restored, err := NewTracker(budgets, path)
+	if err != nil {
+		t.Fatalf("NewTracker: %v", err)
+	}
+	if got := restored.Remaining("a", now).Daily; got != 40 {
+		t.Errorf("restored daily budget left of a = %d, want 40", got)
+	}
+	if got := restored.Remaining("b", now).Daily; got != 70 {
+		t.Errorf("restored daily budget left of b = %d, want 70", got)
+	}
+	if _, ok := restored.usage["never-charged"]; ok {
+		t.Error("client without usage was saved")
+	}
+}
+
+func TestTrackerRetriesFailedSave(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	path := filepath.Join(dir, "budgets.json")
+	budgets := Budgets{Default: Budget{Daily: 100}}
+
+	tr, err := NewTracker(budgets, path)
+	if err != nil {
+		t.Fatalf("NewTracker: %v", err)
+	}
+	tr.Add("a", 30, time.Now())
+	// the state directory does not exist yet, so the save fails and must not count as done.
+	if err := tr.Flush(); err == nil {
+		t.Fatal("Flush succeeded without a state directory")
+	}
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatalf("create state directory: %v", err)
+	}
+	if err := tr.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	restored, err := NewTracker(budgets, path)
+	if err != nil {
+		t.Fatalf("NewTracker: %v", err)
+	}
+	if got := restored.Remaining("a", time.Now()).Daily; got != 70 {
+		t.Errorf("restored daily budget left of a = %d, want 70", got)
+	}
+}
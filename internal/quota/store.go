@@ -0,0 +1,54 @@
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// fileStore saves the usage counters as json, replacing the file atomically so a crash
+// cannot leave it half written.
+type fileStore struct {
+	path string
+}
+
+func (s *fileStore) load() (map[string]*Usage, error) {
+	usage := make(map[string]*Usage)
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return usage, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read quota state: %w", err)
+	}
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return nil, fmt.Errorf("decode quota state %s: %w", s.path, err)
+	}
+	return usage, nil
+}
+
+func (s *fileStore) save(usage map[string]Usage) error {
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return fmt.Errorf("encode quota state: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("save quota state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("save quota state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("save quota state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("save quota state: %w", err)
+	}
+	return nil
+}
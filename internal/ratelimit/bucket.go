@@ -0,0 +1,58 @@
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// bucket is a token bucket that holds up to capacity and refills at capacity per minute.
+// The level may go negative when a reservation is reconciled against a larger actual usage,
+// which delays the next requests until the debt is refilled.
+type bucket struct {
+	capacity float64
+	level    float64
+	last     time.Time
+}
+
+func newBucket(perMinute int, now time.Time) *bucket {
+	return &bucket{
+		capacity: float64(perMinute),
+		level:    float64(perMinute),
+		last:     now,
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.level = math.Min(b.capacity, b.level+b.capacity*elapsed.Minutes())
+		b.last = now
+	}
+}
+
+// wait returns how long until n can be taken.
+func (b *bucket) wait(n float64) time.Duration {
+	if b.level >= n {
+		return 0
+	}
+	return time.Duration((n - b.level) / b.capacity * float64(time.Minute))
+}
+
+// reset returns how long until the bucket is full again.
+func (b *bucket) reset() time.Duration {
+	return b.wait(b.capacity)
+}
+
+// full reports whether the bucket holds its whole capacity.
+func (b *bucket) full() bool {
+	return b.level >= b.capacity
+}
+
+// remaining returns the whole tokens left in the bucket.
+func (b *bucket) remaining() int {
+	return int(math.Max(0, math.Floor(b.level)))
+}
+
+// add puts n back into the bucket, or takes it out when n is negative.
+func (b *bucket) add(n float64) {
+	b.level = math.Min(b.capacity, b.level+n)
+}
@@ -0,0 +1,282 @@
+// package ratelimit limits the requests and tokens per minute of each client and model with
+// token buckets.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons a request is rejected, used as the reason metric label.
+const (
+	ReasonRequests = "requests"
+	ReasonTokens   = "tokens"
+)
+
+// Limit is the number of requests and tokens allowed per minute. Zero means unlimited.
+type Limit struct {
+	RPM int
+	TPM int
+}
+
+// Limits holds the limits of each client and model. The default client limit applies to each
+// client without its own. The default model limit is shared by all models without their own,
+// as an upstream such as llama-server serves any requested model name with the model it has
+// loaded, so a limit per name could be evaded by varying the name.
+type Limits struct {
+	DefaultClient Limit
+	DefaultModel  Limit
+	Clients       map[string]Limit
+	Models        map[string]Limit
+}
+
+// ParseLimits parses a comma separated list of scope:name=rpm/tpm limits where scope is
+// client or model and name default sets the default of the scope, e.g.
+// "client:default=60/100000,client:batch=10/,model:gpt-oss-20b=/200000". Either limit may be
+// empty or 0 for no limit.
+func ParseLimits(s string) (Limits, error) {
+	limits := Limits{
+		Clients: make(map[string]Limit),
+		Models:  make(map[string]Limit),
+	}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, values, ok := strings.Cut(entry, "=")
+		scope, name, okKey := strings.Cut(key, ":")
+		rpm, tpm, okValues := strings.Cut(values, "/")
+		if !ok || !okKey || !okValues || name == "" {
+			return Limits{}, fmt.Errorf("rate limit %q must be scope:name=rpm/tpm", entry)
+		}
+		var limit Limit
+		var err error
+		if limit.RPM, err = parsePerMinute(rpm); err != nil {
+			return Limits{}, fmt.Errorf("rate limit %q: %w", entry, err)
+		}
+		if limit.TPM, err = parsePerMinute(tpm); err != nil {
+			return Limits{}, fmt.Errorf("rate limit %q: %w", entry, err)
+		}
+		switch {
+		case scope == "client" && name == "default":
+			limits.DefaultClient = limit
+		case scope == "client":
+			limits.Clients[name] = limit
+		case scope == "model" && name == "default":
+			limits.DefaultModel = limit
+		case scope == "model":
+			limits.Models[name] = limit
+		default:
+			return Limits{}, fmt.Errorf("rate limit %q: scope must be client or model", entry)
+		}
+	}
+	return limits, nil
+}
+
+func parsePerMinute(s string) (int, error) {
+	if s = strings.TrimSpace(s); s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid limit %q", s)
+	}
+	return n, nil
+}
+
+// sweepInterval is how often the buckets that refilled completely are dropped.
+const sweepInterval = time.Minute
+
+// limitBuckets are the buckets of one client or model. A nil bucket is unlimited.
+type limitBuckets struct {
+	requests *bucket
+	tokens   *bucket
+	// pending counts the reservations that are not reconciled yet.
+	pending int
+}
+
+// idle reports whether the buckets are full and not reserved, so they can be dropped and
+// recreated on next use without changing any limit.
+func (b *limitBuckets) idle() bool {
+	return b.pending == 0 &&
+		(b.requests == nil || b.requests.full()) &&
+		(b.tokens == nil || b.tokens.full())
+}
+
+// Limiter limits the requests and tokens per minute of each client and model.
+type Limiter struct {
+	limits Limits
+
+	mu        sync.Mutex
+	buckets   map[string]*limitBuckets
+	lastSweep time.Time
+}
+
+// NewLimiter creates a limiter for the limits.
+func NewLimiter(limits Limits) *Limiter {
+	return &Limiter{
+		limits:  limits,
+		buckets: make(map[string]*limitBuckets),
+	}
+}
+
+// Status describes the most restrictive request and token limits that apply to a request,
+// as reported in the x-ratelimit-* headers. A zero limit means unlimited.
+type Status struct {
+	LimitRequests     int
+	RemainingRequests int
+	ResetRequests     time.Duration
+	LimitTokens       int
+	RemainingTokens   int
+	ResetTokens       time.Duration
+}
+
+// Reservation is the result of Reserve. When OK is false the request must be rejected for
+// Reason and may be retried after RetryAfter.
+type Reservation struct {
+	OK         bool
+	Reason     string
+	RetryAfter time.Duration
+	Status     Status
+
+	limiter *Limiter
+	buckets []*limitBuckets
+	tokens  float64
+	once    sync.Once
+}
+
+// Reserve takes one request and the estimated tokens from the buckets of the client and the
+// model. Nothing is taken when any bucket is short; the reservation then reports why.
+func (l *Limiter) Reserve(client, model string, tokens int, now time.Time) *Reservation {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	r := &Reservation{OK: true, limiter: l, tokens: float64(tokens)}
+	if b := l.bucketsFor("client:", l.limits.Clients, l.limits.DefaultClient, client, now); b != nil {
+		r.buckets = append(r.buckets, b)
+	}
+	if _, ok := l.limits.Models[model]; !ok {
+		model = "" // models without their own limit share the default bucket
+	}
+	if b := l.bucketsFor("model:", l.limits.Models, l.limits.DefaultModel, model, now); b != nil {
+		r.buckets = append(r.buckets, b)
+	}
+
+	for _, b := range r.buckets {
+		if b.requests != nil {
+			if wait := b.requests.wait(1); wait > 0 && wait >= r.RetryAfter {
+				r.OK, r.Reason, r.RetryAfter = false, ReasonRequests, wait
+			}
+		}
+		if b.tokens != nil {
+			// a request larger than the limit is let through once the bucket is full.
+			if wait := b.tokens.wait(math.Min(r.tokens, b.tokens.capacity)); wait > 0 && wait >= r.RetryAfter {
+				r.OK, r.Reason, r.RetryAfter = false, ReasonTokens, wait
+			}
+		}
+	}
+	if r.OK {
+		for _, b := range r.buckets {
+			b.pending++
+			if b.requests != nil {
+				b.requests.add(-1)
+			}
+			if b.tokens != nil {
+				b.tokens.add(-r.tokens)
+			}
+		}
+	}
+	r.Status = status(r.buckets)
+	return r
+}
+
+// Reconcile replaces the estimated tokens of the reservation with the tokens actually used.
+// Only the first call has an effect, and it does nothing for rejected reservations.
+func (r *Reservation) Reconcile(tokens int) {
+	if !r.OK {
+		return
+	}
+	r.once.Do(func() {
+		r.limiter.mu.Lock()
+		defer r.limiter.mu.Unlock()
+		for _, b := range r.buckets {
+			b.pending--
+			if b.tokens != nil {
+				b.tokens.add(r.tokens - float64(tokens))
+			}
+		}
+	})
+}
+
+// bucketsFor returns the refilled buckets of name in scope, creating them on first use, or nil
+// when neither requests nor tokens are limited for name.
+func (l *Limiter) bucketsFor(
+	scope string, limits map[string]Limit, fallback Limit, name string, now time.Time,
+) *limitBuckets {
+	limit, ok := limits[name]
+	if !ok {
+		limit = fallback
+	}
+	if limit.RPM == 0 && limit.TPM == 0 {
+		return nil
+	}
+	key := scope + name
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &limitBuckets{}
+		if limit.RPM > 0 {
+			b.requests = newBucket(limit.RPM, now)
+		}
+		if limit.TPM > 0 {
+			b.tokens = newBucket(limit.TPM, now)
+		}
+		l.buckets[key] = b
+	}
+	if b.requests != nil {
+		b.requests.refill(now)
+	}
+	if b.tokens != nil {
+		b.tokens.refill(now)
+	}
+	return b
+}
+
+// sweep drops the idle buckets once per sweepInterval, so the limiter does not keep a bucket
+// for every client that ever made a request.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.requests != nil {
+			b.requests.refill(now)
+		}
+		if b.tokens != nil {
+			b.tokens.refill(now)
+		}
+		if b.idle() {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// status returns the limits with the fewest remaining requests and tokens.
+func status(buckets []*limitBuckets) Status {
+	var s Status
+	for _, b := range buckets {
+		if r := b.requests; r != nil && (s.LimitRequests == 0 || r.remaining() < s.RemainingRequests) {
+			s.LimitRequests, s.RemainingRequests, s.ResetRequests = int(r.capacity), r.remaining(), r.reset()
+		}
+		if t := b.tokens; t != nil && (s.LimitTokens == 0 || t.remaining() < s.RemainingTokens) {
+			s.LimitTokens, s.RemainingTokens, s.ResetTokens = int(t.capacity), t.remaining(), t.reset()
+		}
+	}
+	return s
+}
@@ -0,0 +1,144 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLimits(t *testing.T) {
+	limits, err := ParseLimits("client:default=60/100000, client:batch=10/, model:gpt-oss-20b=/200000")
+	if err != nil {
+		t.Fatalf("ParseLimits: %v", err)
+	}
+	if limits.DefaultClient != (Limit{RPM: 60, TPM: 100000}) {
+		t.Errorf("DefaultClient = %+v", limits.DefaultClient)
+	}
+	if limits.Clients["batch"] != (Limit{RPM: 10}) {
+		t.Errorf("Clients[batch] = %+v", limits.Clients["batch"])
+	}
+	if limits.Models["gpt-oss-20b"] != (Limit{TPM: 200000}) {
+		t.Errorf("Models[gpt-oss-20b] = %+v", limits.Models["gpt-oss-20b"])
+	}
+
+	for _, spec := range []string{"client=1/1", "client:batch=1", "team:batch=1/1", "client:batch=x/1"} {
+		if _, err := ParseLimits(spec); err == nil {
+			t.Errorf("ParseLimits(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestReserve(t *testing.T) {
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	type reserve struct {
+		client, model string
+		tokens        int
+		at            time.Duration
+		ok            bool
+		reason        string
+	}
+	tests := []struct {
+		name     string
+		limits   Limits
+		reserves []reserve
+	}{
+		{
+			name:   "requests per minute",
+			limits: Limits{DefaultClient: Limit{RPM: 2}},
+			reserves: []reserve{
+				{client: "a", ok: true},
+				{client: "a", ok: true},
+				{client: "a", ok: false, reason: ReasonRequests},
+				{client: "b", ok: true},
+				{client: "a", at: 30 * time.Second, ok: true},
+			},
+		},
+		{
+			name:   "tokens per minute",
+			limits: Limits{Clients: map[string]Limit{"a": {TPM: 100}}},
+			reserves: []reserve{
+				{client: "a", tokens: 60, ok: true},
+				{client: "a", tokens: 60, ok: false, reason: ReasonTokens},
+				{client: "a", tokens: 60, at: 12 * time.Second, ok: true},
+				{client: "b", tokens: 1000, ok: true},
+			},
+		},
+		{
+			name:   "request larger than the limit waits for a full bucket",
+			limits: Limits{DefaultClient: Limit{TPM: 100}},
+			reserves: []reserve{
+				{client: "a", tokens: 500, ok: true},
+				{client: "a", tokens: 500, at: 30 * time.Second, ok: false, reason: ReasonTokens},
+			},
+		},
+		{
+			name: "models without a limit share the default",
+			limits: Limits{
+				DefaultModel: Limit{TPM: 100},
+				Models:       map[string]Limit{"big": {TPM: 1000}},
+			},
+			reserves: []reserve{
+				{model: "m0", tokens: 90, ok: true},
+				{model: "m1", tokens: 90, ok: false, reason: ReasonTokens},
+				{model: "big", tokens: 900, ok: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLimiter(tt.limits)
+			for i, r := range tt.reserves {
+				res := l.Reserve(r.client, r.model, r.tokens, start.Add(r.at))
+				if res.OK != r.ok || res.Reason != r.reason {
+					t.Fatalf("reserve %d: ok %v reason %q, want ok %v reason %q", i, res.OK, res.Reason, r.ok, r.reason)
+				}
+				if !res.OK && res.RetryAfter <= 0 {
+					t.Errorf("reserve %d: RetryAfter = %s, want a positive wait", i, res.RetryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		estimate  int
+		actual    int
+		remaining int
+	}{
+		{"overestimate is given back", 80, 20, 80},
+		{"underestimate is charged", 20, 60, 40},
+		{"usage over the limit goes into debt", 20, 150, 0},
+		{"no response gives everything back", 50, 0, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLimiter(Limits{DefaultClient: Limit{TPM: 100}})
+			res := l.Reserve("a", "", tt.estimate, now)
+			res.Reconcile(tt.actual)
+			res.Reconcile(tt.estimate) // only the first call counts
+			if got := l.Reserve("a", "", 0, now).Status.RemainingTokens; got != tt.remaining {
+				t.Errorf("remaining tokens = %d, want %d", got, tt.remaining)
+			}
+		})
+	}
+}
+
+func TestIdleBucketsAreDropped(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := NewLimiter(Limits{DefaultClient: Limit{RPM: 10}})
+	for _, client := range []string{"a", "b", "c"} {
+		l.Reserve(client, "", 0, now).Reconcile(0)
+	}
+	pending := l.Reserve("pending", "", 0, now)
+
+	l.Reserve("d", "", 0, now.Add(2*sweepInterval))
+	if _, ok := l.buckets["client:a"]; ok {
+		t.Error("idle bucket of a was kept")
+	}
+	if _, ok := l.buckets["client:pending"]; !ok {
+		t.Error("bucket with an unreconciled reservation was dropped")
+	}
+	pending.Reconcile(0)
+}
@@ -1,120 +1,59 @@
+// Package types is a compatibility shim for the OpenAI response types that now live in
+// github.com/soypete/pedro-ops/types. The aliases let existing importers pass values
+// between packages without conversion.
+//
+// Deprecated: import github.com/soypete/pedro-ops/types instead.
 package types
 
-import "time"
-
-// ChatCompletionResponse represents the response from OpenAI chat completions API
-type ChatCompletionResponse struct {
-	ID      string                 `json:"id"`
-	Object  string                 `json:"object"`
-	Created int64                  `json:"created"`
-	Model   string                 `json:"model"`
-	Choices []ChatCompletionChoice `json:"choices"`
-	Usage   Usage                  `json:"usage"`
-}
-
-// ChatCompletionChoice represents a single choice in the completion response
-type ChatCompletionChoice struct {
-	Index        int                    `json:"index"`
-	Message      ChatCompletionMessage  `json:"message"`
-	FinishReason string                 `json:"finish_reason"`
-	Delta        *ChatCompletionMessage `json:"delta,omitempty"`
-}
-
-// ChatCompletionMessage represents a message in the chat completion
-type ChatCompletionMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
-}
-
-// EmbeddingResponse represents the response from OpenAI embeddings API
-type EmbeddingResponse struct {
-	Object string      `json:"object"`
-	Data   []Embedding `json:"data"`
-	Model  string      `json:"model"`
-	Usage  Usage       `json:"usage"`
-}
-
-// Embedding represents a single embedding result
-type Embedding struct {
-	Object    string    `json:"object"`
-	Index     int       `json:"index"`
-	Embedding []float64 `json:"embedding"`
-}
-
-// Usage represents token usage information in API responses
-type Usage struct {
-	PromptTokens            int                     `json:"prompt_tokens"`
-	CompletionTokens        int                     `json:"completion_tokens,omitempty"`
-	TotalTokens             int                     `json:"total_tokens"`
-	PromptTokensDetails     PromptTokensDetails     `json:"prompt_tokens_details"`
-	CompletionTokensDetails CompletionTokensDetails `json:"completion_tokens_details"`
-	ServiceTier             string                  `json:"service_tier"`
-}
-
-// PromptTokensDetails contains details about prompt tokens
-type PromptTokensDetails struct {
-	CachedTokens int `json:"cached_tokens"`
-	AudioTokens  int `json:"audio_tokens"`
-}
-
-// CompletionTokensDetails contains details about completion tokens
-type CompletionTokensDetails struct {
-	ReasoningTokens          int `json:"reasoning_tokens"`
-	AudioTokens              int `json:"audio_tokens"`
-	AcceptedPredictionTokens int `json:"accepted_prediction_tokens"`
-	RejectedPredictionTokens int `json:"rejected_prediction_tokens"`
-}
-
-// ResponseMetrics contains timing and performance metrics for API calls
-type ResponseMetrics struct {
-	RequestStartTime  time.Time
-	ResponseStartTime time.Time
-	FirstTokenTime    time.Time
-	ResponseEndTime   time.Time
-	Model             string
-	PromptTokens      int
-	CompletionTokens  int
-	TotalTokens       int
-	RequestSize       int64
-	ResponseSize      int64
-	Endpoint          string
-	StatusCode        int
-}
-
-// CalculateMetrics computes derived metrics from the response data
-func (rm *ResponseMetrics) CalculateMetrics() map[string]float64 {
-	metrics := make(map[string]float64)
-
-	// API Latency (total time)
-	if !rm.ResponseEndTime.IsZero() && !rm.RequestStartTime.IsZero() {
-		metrics["api_latency_ms"] = float64(rm.ResponseEndTime.Sub(rm.RequestStartTime).Nanoseconds()) / 1e6
-	}
-
-	// Time to First Token (TTFT)
-	if !rm.FirstTokenTime.IsZero() && !rm.RequestStartTime.IsZero() {
-		metrics["time_to_first_token_ms"] = float64(rm.FirstTokenTime.Sub(rm.RequestStartTime).Nanoseconds()) / 1e6
-	}
-
-	// Prompt Processing Time
-	if !rm.ResponseStartTime.IsZero() && !rm.RequestStartTime.IsZero() {
-		metrics["prompt_processing_time_ms"] = float64(rm.ResponseStartTime.Sub(rm.RequestStartTime).Nanoseconds()) / 1e6
-	}
-
-	// Token Generation Time
-	if !rm.ResponseEndTime.IsZero() && !rm.FirstTokenTime.IsZero() && rm.CompletionTokens > 0 {
-		totalGenTime := rm.ResponseEndTime.Sub(rm.FirstTokenTime)
-		metrics["token_generation_time_ms"] = float64(totalGenTime.Nanoseconds()) / 1e6
-		metrics["tokens_per_second"] = float64(rm.CompletionTokens) / totalGenTime.Seconds()
-	}
-
-	// Token counts
-	metrics["prompt_tokens"] = float64(rm.PromptTokens)
-	metrics["completion_tokens"] = float64(rm.CompletionTokens)
-	metrics["total_tokens"] = float64(rm.TotalTokens)
-
-	// Request/Response sizes
-	metrics["request_size_bytes"] = float64(rm.RequestSize)
-	metrics["response_size_bytes"] = float64(rm.ResponseSize)
-
-	return metrics
-}
+import "github.com/soypete/pedro-ops/types"
+
+type (
+	// Deprecated: use types.ChatCompletionResponse.
+	ChatCompletionResponse = types.ChatCompletionResponse
+	// Deprecated: use types.ChatCompletionChoice.
+	ChatCompletionChoice = types.ChatCompletionChoice
+	// Deprecated: use types.ChatCompletionMessage.
+	ChatCompletionMessage = types.ChatCompletionMessage
+	// Deprecated: use types.ToolCall.
+	ToolCall = types.ToolCall
+	// Deprecated: use types.FunctionCall.
+	FunctionCall = types.FunctionCall
+	// Deprecated: use types.CompletionResponse.
+	CompletionResponse = types.CompletionResponse
+	// Deprecated: use types.CompletionChoice.
+	CompletionChoice = types.CompletionChoice
+	// Deprecated: use types.CompletionLogprobs.
+	CompletionLogprobs = types.CompletionLogprobs
+	// Deprecated: use types.EmbeddingResponse.
+	EmbeddingResponse = types.EmbeddingResponse
+	// Deprecated: use types.Embedding.
+	Embedding = types.Embedding
+	// Deprecated: use types.ErrorResponse.
+	ErrorResponse = types.ErrorResponse
+	// Deprecated: use types.ErrorDetail.
+	ErrorDetail = types.ErrorDetail
+	// Deprecated: use types.ErrorCode.
+	ErrorCode = types.ErrorCode
+	// Deprecated: use types.ChatCompletionRequest.
+	ChatCompletionRequest = types.ChatCompletionRequest
+	// Deprecated: use types.ChatCompletionRequestMessage.
+	ChatCompletionRequestMessage = types.ChatCompletionRequestMessage
+	// Deprecated: use types.Tool.
+	Tool = types.Tool
+	// Deprecated: use types.FunctionDefinition.
+	FunctionDefinition = types.FunctionDefinition
+	// Deprecated: use types.CompletionRequest.
+	CompletionRequest = types.CompletionRequest
+	// Deprecated: use types.EmbeddingRequest.
+	EmbeddingRequest = types.EmbeddingRequest
+	// Deprecated: use types.Usage.
+	Usage = types.Usage
+	// Deprecated: use types.PromptTokensDetails.
+	PromptTokensDetails = types.PromptTokensDetails
+	// Deprecated: use types.CompletionTokensDetails.
+	CompletionTokensDetails = types.CompletionTokensDetails
+	// Deprecated: use types.LlamaCppTimings.
+	LlamaCppTimings = types.LlamaCppTimings
+	// Deprecated: use types.ResponseMetrics.
+	ResponseMetrics = types.ResponseMetrics
+)
@@ -1,5 +1,188 @@
 package main
 
+import (
+	"context"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/soypete/pedro-ops/internal/metrics"
+	"github.com/soypete/pedro-ops/internal/middleware"
+	"github.com/soypete/pedro-ops/internal/proxy"
+	"github.com/soypete/pedro-ops/internal/quota"
+	"github.com/soypete/pedro-ops/internal/ratelimit"
+)
+
+func envOrDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// config holds the command line configuration.
+type config struct {
+	listenAddr   string
+	upstreamURL  string
+	clientTokens string
+	budgets      string
+	budgetState  string
+	rateLimits   string
+	pricing      string
+	routes       string
+	fallbackURL  string
+	retries      string
+	timeout      string
+}
+
+func parseFlags() config {
+	var cfg config
+	flag.StringVar(&cfg.listenAddr, "listen", envOrDefault("LISTEN_ADDR", ":8081"), "address the proxy listens on")
+	flag.StringVar(&cfg.upstreamURL, "upstream", envOrDefault("UPSTREAM_URL", "http://localhost:8080"),
+		"base url of the OpenAI compatible upstream, e.g. the llama-server on pedrogpt")
+	// the tokens are not used as the flag default so they are not printed by -help.
+	flag.StringVar(&cfg.clientTokens, "client-tokens", "",
+		"comma separated name=token pairs naming the clients that send each bearer token (env CLIENT_TOKENS)")
+	flag.StringVar(&cfg.budgets, "budgets", envOrDefault("TOKEN_BUDGETS", ""),
+		"comma separated name=daily/monthly token budgets, the default entry applies to other clients")
+	flag.StringVar(&cfg.budgetState, "budget-state", envOrDefault("BUDGET_STATE", ""),
+		"file the budget usage counters are saved to, kept in memory if empty")
+	flag.StringVar(&cfg.rateLimits, "rate-limits", envOrDefault("RATE_LIMITS", ""),
+		"comma separated client:name=rpm/tpm and model:name=rpm/tpm limits, name default applies to the rest")
+	flag.StringVar(&cfg.pricing, "pricing", envOrDefault("PRICING_FILE", ""),
+		"json file with the price of each model, used to record openai_cost_dollars_total")
+	flag.StringVar(&cfg.routes, "routes", envOrDefault("ROUTES_FILE", ""),
+		"json file routing models to upstreams, replaces -upstream when set")
+	flag.StringVar(&cfg.fallbackURL, "fallback-upstream", envOrDefault("FALLBACK_UPSTREAM_URL", ""),
+		"base url of the upstream requests fail over to when -upstream is down, the routes name their own")
+	flag.StringVar(&cfg.retries, "retries", envOrDefault("RETRIES", strconv.Itoa(proxy.DefaultRetryPolicy.Retries)),
+		"number of times failed requests are retried on an upstream before failing over")
+	defaultTimeout := proxy.DefaultRetryPolicy.Timeout.String()
+	flag.StringVar(&cfg.timeout, "upstream-timeout", envOrDefault("UPSTREAM_TIMEOUT", defaultTimeout),
+		"how long an upstream may take to send the response headers, 0 waits for the longest generation")
+	flag.Parse()
+
+	if cfg.clientTokens == "" {
+		cfg.clientTokens = os.Getenv("CLIENT_TOKENS")
+	}
+	return cfg
+}
+
+// proxyOptions builds the client identification, routing, retry, token budget and rate limit
+// options of the proxy.
+func proxyOptions(cfg config) ([]proxy.Option, error) {
+	tokens, err := middleware.ParseClientTokens(cfg.clientTokens)
+	if err != nil {
+		return nil, fmt.Errorf("parse client tokens: %w", err)
+	}
+	retry := proxy.DefaultRetryPolicy
+	if retry.Retries, err = strconv.Atoi(cfg.retries); err != nil || retry.Retries < 0 {
+		return nil, fmt.Errorf("invalid retries %q", cfg.retries)
+	}
+	if retry.Timeout, err = time.ParseDuration(cfg.timeout); err != nil {
+		return nil, fmt.Errorf("parse upstream timeout: %w", err)
+	}
+	opts := []proxy.Option{
+		proxy.WithClientIdentifier(middleware.NewClientIdentifier(tokens)),
+		proxy.WithRetryPolicy(retry),
+	}
+	if cfg.fallbackURL != "" {
+		opts = append(opts, proxy.WithFallback(cfg.fallbackURL))
+	}
+
+	if cfg.routes != "" {
+		router, err := proxy.LoadRouter(cfg.routes)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, proxy.WithRouter(router))
+	}
+
+	if cfg.budgets != "" {
+		budgets, err := quota.ParseBudgets(cfg.budgets)
+		if err != nil {
+			return nil, err
+		}
+		tracker, err := quota.NewTracker(budgets, cfg.budgetState)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, proxy.WithQuota(tracker))
+	}
+
+	if cfg.rateLimits != "" {
+		limits, err := ratelimit.ParseLimits(cfg.rateLimits)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, proxy.WithRateLimits(ratelimit.NewLimiter(limits)))
+	}
+	return opts, nil
+}
+
 func main() {
-	// TODO: implement server startup
+	cfg := parseFlags()
+
+	metricsOpts := []metrics.ClientOption{
+		metrics.WithRegisterer(prometheus.DefaultRegisterer),
+		metrics.WithClientLabel(0),
+		metrics.WithUpstreamLabel(),
+	}
+	if cfg.pricing != "" {
+		pricing, err := metrics.LoadPricing(cfg.pricing)
+		if err != nil {
+			log.Fatalf("Error loading pricing: %v", err)
+		}
+		metricsOpts = append(metricsOpts, metrics.WithPricing(pricing))
+	}
+	metricsClient := metrics.NewClient(metricsOpts...)
+	proxyOpts, err := proxyOptions(cfg)
+	if err != nil {
+		log.Fatalf("Error configuring proxy: %v", err)
+	}
+	p, err := proxy.New(cfg.upstreamURL, metricsClient, proxyOpts...)
+	if err != nil {
+		log.Fatalf("Error creating proxy: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/v1/", p.Handler())
+	mux.Handle("/metrics", metricsClient.Handler())
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	server := &http.Server{
+		Addr:              cfg.listenAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		log.Printf("proxying %s to %s", cfg.listenAddr, cfg.upstreamURL)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Error starting server: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
+	if err := p.Close(); err != nil {
+		log.Printf("Error closing proxy: %v", err)
+	}
 }
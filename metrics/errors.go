@@ -0,0 +1,14 @@
+package metrics
+
+import "github.com/soypete/pedro-ops/internal/middleware"
+
+// Errors returned when metrics cannot be extracted from a response. Use errors.As to
+// tell them apart.
+type (
+	// UnknownEndpointError is returned for an endpoint that is not supported.
+	UnknownEndpointError = middleware.UnknownEndpointError
+	// MalformedResponseError is returned when the body is not a valid response for the endpoint.
+	MalformedResponseError = middleware.MalformedResponseError
+	// APIError is returned when the body is an OpenAI error envelope.
+	APIError = middleware.APIError
+)
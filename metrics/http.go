@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/soypete/pedro-ops/internal/middleware"
+	"github.com/soypete/pedro-ops/types"
+)
+
+// Recorder records the metrics of a completed OpenAI API call.
+type Recorder interface {
+	RecordMetrics(metrics *types.ResponseMetrics)
+}
+
+// NewTransport wraps base in an http.RoundTripper that records metrics for every chat
+// completion, text completion and embedding request sent through it. Response bodies are still returned
+// to the caller in full, and streamed responses are not buffered. If base is nil
+// http.DefaultTransport is used.
+//
+//	client := &http.Client{Transport: metrics.NewTransport(http.DefaultTransport, recorder)}
+func NewTransport(base http.RoundTripper, recorder Recorder) http.RoundTripper {
+	return middleware.NewOpenAIMiddleware().NewTransport(base, recorder)
+}
+
+// Middleware returns http middleware that records metrics for the chat completion, text
+// completion and embedding endpoints served by the wrapped handler, including streamed
+// responses.
+//
+//	mux.Handle("/v1/", metrics.Middleware(recorder)(apiHandler))
+func Middleware(recorder Recorder) func(http.Handler) http.Handler {
+	return middleware.NewOpenAIMiddleware().Handler(recorder)
+}
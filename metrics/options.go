@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/soypete/pedro-ops/types"
+)
+
+// requestContext holds the request side details of a call that cannot be read from
+// the response body.
+type requestContext struct {
+	startTime   time.Time
+	endpoint    string
+	statusCode  int
+	requestSize int64
+	model       string
+	labels      map[string]string
+	requestBody []byte
+	client      string
+}
+
+// Option configures the request context used when calculating metrics.
+type Option func(*requestContext)
+
+// WithStartTime sets the time the request to the llm was made. It defaults to the
+// time CalculateMetrics is called.
+func WithStartTime(t time.Time) Option {
+	return func(rc *requestContext) {
+		rc.startTime = t
+	}
+}
+
+// WithEndpoint sets the endpoint the request was sent to, one of the types.Endpoint*
+// constants. It defaults to types.EndpointChatCompletions.
+func WithEndpoint(endpoint string) Option {
+	return func(rc *requestContext) {
+		rc.endpoint = endpoint
+	}
+}
+
+// WithStatusCode sets the http status code of the response.
+func WithStatusCode(code int) Option {
+	return func(rc *requestContext) {
+		rc.statusCode = code
+	}
+}
+
+// WithRequestSize sets the size of the request body in bytes.
+func WithRequestSize(size int64) Option {
+	return func(rc *requestContext) {
+		rc.requestSize = size
+	}
+}
+
+// WithRequestBody sets the json request body that was sent, so the requested model and
+// parameters such as max_tokens and temperature are included in the metrics. The request
+// size defaults to the length of body.
+func WithRequestBody(body []byte) Option {
+	return func(rc *requestContext) {
+		rc.requestBody = body
+	}
+}
+
+// WithClient attributes the request to the named client, e.g. the application that made it.
+func WithClient(name string) Option {
+	return func(rc *requestContext) {
+		rc.client = name
+	}
+}
+
+// WithModel overrides the model reported in the response, e.g. when the server
+// reports a file path instead of a model name.
+func WithModel(model string) Option {
+	return func(rc *requestContext) {
+		rc.model = model
+	}
+}
+
+// WithLabels attaches extra labels to the response metrics, e.g. the team or feature that made
+// the request. A metrics client created with WithRequestLabels records the ones it names as
+// labels of openai_requests_total. Labels from multiple calls are merged.
+func WithLabels(labels map[string]string) Option {
+	return func(rc *requestContext) {
+		if rc.labels == nil {
+			rc.labels = make(map[string]string, len(labels))
+		}
+		for k, v := range labels {
+			rc.labels[k] = v
+		}
+	}
+}
+
+func newRequestContext(opts []Option) requestContext {
+	rc := requestContext{
+		endpoint: types.EndpointChatCompletions, // default to chat completions
+	}
+	for _, opt := range opts {
+		opt(&rc)
+	}
+	if rc.startTime.IsZero() {
+		rc.startTime = time.Now()
+	}
+	if rc.requestSize == 0 {
+		rc.requestSize = int64(len(rc.requestBody))
+	}
+	return rc
+}
@@ -2,21 +2,26 @@
 package metrics
 
 import (
-	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"time"
 
 	"github.com/soypete/pedro-ops/internal/middleware"
 	"github.com/soypete/pedro-ops/types"
 )
 
+// Calculator calculates response metrics and their derived values from OpenAI API responses.
 type Calculator interface {
 	// CalculateMetrics calculates the metrics from the given response. the []bytes is passed right to
 	// the json unmarshaler. so you will need to allocate the slice from your io reader body.
-	CalculateMetrics([]byte) types.ResponseMetrics
+	CalculateMetrics(respBody []byte, opts ...Option) (types.ResponseMetrics, map[string]float64, error)
+	// CalculateStreamMetrics calculates the metrics from a `stream: true` chat completion body.
+	// The reader is consumed until EOF so the time of the first content chunk can be observed.
+	CalculateStreamMetrics(body io.Reader, opts ...Option) (types.ResponseMetrics, map[string]float64, error)
 }
 
+var _ Calculator = (*OpenAICalculator)(nil)
+
 type OpenAICalculator struct {
 	// prometheus client
 	mw *middleware.OpenAIMiddleware
@@ -29,47 +34,75 @@ func SetupCalculator() *OpenAICalculator {
 }
 
 // CalculateMetrics calculates the metrics from the given response. the []bytes is passed right to
-// the json unmarshaler. so you will need to allocate the slice from your io reader body. opts include in
-// order, time that the request was made, and endpoint name.
+// the json unmarshaler. so you will need to allocate the slice from your io reader body. Use the
+// With* options to describe the request, e.g. WithStartTime and WithEndpoint. The error is an
+// *UnknownEndpointError, *MalformedResponseError or *APIError when no metrics could be extracted.
 func (c *OpenAICalculator) CalculateMetrics(
-	respBody []byte, opts ...any,
+	respBody []byte, opts ...Option,
 ) (types.ResponseMetrics, map[string]float64, error) {
-	var responseMetrics types.ResponseMetrics // TODO: maybe have this be an optional config that is passed
-	var endpointName string
+	rc := newRequestContext(opts)
+	responseMetrics := c.responseMetrics(&rc)
 
-	// check if opts were sent
-	if len(opts) < 1 {
-		responseMetrics.RequestStartTime = time.Now()
-		responseMetrics.ResponseStartTime = time.Now()
-		endpointName = "completions" // default to completions
-	} else {
-		startTime, ok := opts[0].(time.Time)
-		if !ok {
-			return responseMetrics, nil, fmt.Errorf("expected time.Time for opts[0]")
-		}
-		responseMetrics.RequestStartTime = startTime
-		responseMetrics.ResponseStartTime = time.Now()
-		name, ok := opts[1].(string)
-		if !ok {
-			return responseMetrics, nil, fmt.Errorf("expected string for opts[1]")
-		}
-		endpointName = name
-	}
+	responseMetrics.ResponseSize = int64(len(respBody))
+	responseMetrics.ResponseEndTime = time.Now()
 
-	err := json.Unmarshal(respBody, &responseMetrics)
-	if err != nil {
-		log.Printf("Error unmarshalling response body: %v", err)
+	// extractMetrics extracts metrics from the response body and updates the responseMetrics struct
+	if err := c.mw.ExtractMetrics(respBody, &responseMetrics, rc.endpoint); err != nil {
+		responseMetrics.ExtractError = err
 		return responseMetrics, nil, err
 	}
+	rc.apply(&responseMetrics)
+	metrics := responseMetrics.CalculateMetrics() // get derived metrics
 
-	// extractMetrics extracts metrics from the response body and updates the responseMetrics struct
-	responseMetrics.ResponseSize = int64(len(respBody))
-	responseMetrics.ResponseEndTime = time.Now()
-	responseMetrics.FirstTokenTime = responseMetrics.ResponseEndTime
+	return responseMetrics, metrics, nil
+}
+
+// CalculateStreamMetrics calculates the metrics from a streamed chat completion. The body is
+// read until EOF, and the time the first content chunk is read is used as the first token time.
+func (c *OpenAICalculator) CalculateStreamMetrics(
+	body io.Reader, opts ...Option,
+) (types.ResponseMetrics, map[string]float64, error) {
+	rc := newRequestContext(opts)
+	responseMetrics := c.responseMetrics(&rc)
 
-	// Extract metrics from response
-	c.mw.ExtractMetrics(respBody, &responseMetrics, endpointName)
+	acc := c.mw.NewStreamAccumulator(&responseMetrics)
+	size, err := io.Copy(acc, body)
+	if err != nil {
+		return responseMetrics, nil, fmt.Errorf("read response stream: %w", err)
+	}
+	responseMetrics.ResponseSize = size
+	responseMetrics.ResponseEndTime = time.Now()
+	if err := acc.Finish(); err != nil {
+		responseMetrics.ExtractError = err
+		return responseMetrics, nil, err
+	}
+	rc.apply(&responseMetrics)
 	metrics := responseMetrics.CalculateMetrics() // get derived metrics
 
 	return responseMetrics, metrics, nil
 }
+
+// responseMetrics creates the response metrics for a response that starts now, including the
+// request parameters when a request body was given.
+func (c *OpenAICalculator) responseMetrics(rc *requestContext) types.ResponseMetrics {
+	responseMetrics := types.ResponseMetrics{
+		RequestStartTime:  rc.startTime,
+		ResponseStartTime: time.Now(),
+		Endpoint:          rc.endpoint,
+		StatusCode:        rc.statusCode,
+		RequestSize:       rc.requestSize,
+		Labels:            rc.labels,
+		Client:            rc.client,
+	}
+	if len(rc.requestBody) > 0 {
+		c.mw.ExtractRequestMetrics(rc.requestBody, &responseMetrics, rc.endpoint)
+	}
+	return responseMetrics
+}
+
+// apply sets the values that take precedence over the parsed response.
+func (rc *requestContext) apply(responseMetrics *types.ResponseMetrics) {
+	if rc.model != "" {
+		responseMetrics.Model = rc.model
+	}
+}
@@ -0,0 +1,17 @@
+package types
+
+// LlamaCppTimings are the server side timings llama.cpp's llama-server adds to completion
+// responses. They measure inference only, so comparing them with the client observed
+// latency separates network time from prompt processing and generation.
+type LlamaCppTimings struct {
+	// CacheN is the number of prompt tokens reused from the kv cache.
+	CacheN              int     `json:"cache_n"`
+	PromptN             int     `json:"prompt_n"`
+	PromptMS            float64 `json:"prompt_ms"`
+	PromptPerTokenMS    float64 `json:"prompt_per_token_ms"`
+	PromptPerSecond     float64 `json:"prompt_per_second"`
+	PredictedN          int     `json:"predicted_n"`
+	PredictedMS         float64 `json:"predicted_ms"`
+	PredictedPerTokenMS float64 `json:"predicted_per_token_ms"`
+	PredictedPerSecond  float64 `json:"predicted_per_second"`
+}
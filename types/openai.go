@@ -1,7 +1,27 @@
-// package types defines the data structures for OpenAI API responses and metrics.
+// package types defines the data structures for OpenAI API responses and metrics. It is the
+// public schema shared by the metrics calculator, the http middleware, and the Prometheus
+// client, and follows the module's semantic versioning.
 package types
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
+
+// Endpoint names used as the endpoint of ResponseMetrics and the endpoint metric label.
+const (
+	// EndpointChatCompletions is /v1/chat/completions.
+	EndpointChatCompletions = "chat_completions"
+	// EndpointCompletions is the legacy text completions endpoint /v1/completions.
+	EndpointCompletions = "completions"
+	// EndpointEmbeddings is /v1/embeddings.
+	EndpointEmbeddings = "embeddings"
+)
+
+// minDecodeTime is the shortest time between the first and last streamed token that decode
+// throughput is measured over. Shorter streams arrived in a burst, e.g. from a buffering proxy,
+// and would report an arbitrarily high rate.
+const minDecodeTime = 50 * time.Millisecond
 
 // ChatCompletionResponse represents the response from OpenAI chat completions API
 type ChatCompletionResponse struct {
@@ -11,6 +31,8 @@ type ChatCompletionResponse struct {
 	Model   string                 `json:"model"`
 	Choices []ChatCompletionChoice `json:"choices"`
 	Usage   Usage                  `json:"usage"`
+	// Timings is only sent by llama.cpp.
+	Timings *LlamaCppTimings `json:"timings,omitempty"`
 }
 
 // ChatCompletionChoice represents a single choice in the completion response
@@ -25,6 +47,61 @@ type ChatCompletionChoice struct {
 type ChatCompletionMessage struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// Name is the optional name of the participant that sent the message.
+	Name string `json:"name,omitempty"`
+	// Refusal is set instead of Content when the model refuses to answer.
+	Refusal string `json:"refusal,omitempty"`
+	// ReasoningContent is the thinking of reasoning models, which llama.cpp streams before
+	// the content, e.g. for gpt-oss.
+	ReasoningContent string     `json:"reasoning_content,omitempty"`
+	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
+	// ToolCallID is the id of the tool call a tool role message is responding to.
+	ToolCallID string `json:"tool_call_id,omitempty"`
+}
+
+// ToolCall represents a tool the model asked to call. In streamed responses each delta only
+// carries part of the call and Index identifies which call it belongs to.
+type ToolCall struct {
+	Index    *int         `json:"index,omitempty"`
+	ID       string       `json:"id,omitempty"`
+	Type     string       `json:"type,omitempty"`
+	Function FunctionCall `json:"function"`
+}
+
+// FunctionCall represents the function name and json encoded arguments of a tool call
+type FunctionCall struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+}
+
+// CompletionResponse represents the response from the legacy OpenAI text completions API
+type CompletionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []CompletionChoice `json:"choices"`
+	Usage   Usage              `json:"usage"`
+	// Timings is only sent by llama.cpp.
+	Timings *LlamaCppTimings `json:"timings,omitempty"`
+}
+
+// CompletionChoice represents a single choice in the text completion response. When the
+// request sets echo the prompt is included at the start of Text.
+type CompletionChoice struct {
+	Index        int                 `json:"index"`
+	Text         string              `json:"text"`
+	Logprobs     *CompletionLogprobs `json:"logprobs"`
+	FinishReason string              `json:"finish_reason"`
+}
+
+// CompletionLogprobs contains the log probabilities of the tokens in a text completion.
+// TokenLogprobs entries are nil for echoed prompt tokens that have no log probability.
+type CompletionLogprobs struct {
+	Tokens        []string             `json:"tokens"`
+	TokenLogprobs []*float64           `json:"token_logprobs"`
+	TopLogprobs   []map[string]float64 `json:"top_logprobs"`
+	TextOffset    []int                `json:"text_offset"`
 }
 
 // EmbeddingResponse represents the response from OpenAI embeddings API
@@ -42,6 +119,38 @@ type Embedding struct {
 	Embedding []float64 `json:"embedding"`
 }
 
+// ErrorResponse represents the error envelope returned instead of a result when a request fails
+type ErrorResponse struct {
+	Error *ErrorDetail `json:"error"`
+}
+
+// ErrorDetail describes why a request failed. OpenAI sends a string code while llama.cpp
+// sends the http status code as a number, so Code holds either as a string.
+type ErrorDetail struct {
+	Message string    `json:"message"`
+	Type    string    `json:"type"`
+	Param   string    `json:"param,omitempty"`
+	Code    ErrorCode `json:"code,omitempty"`
+}
+
+// ErrorCode is an error code that may be sent as a json string or number.
+type ErrorCode string
+
+// UnmarshalJSON accepts a json string, number, or null.
+func (c *ErrorCode) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*c = ErrorCode(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*c = ErrorCode(n.String())
+	return nil
+}
+
 // Usage represents token usage information in API responses
 type Usage struct {
 	PromptTokens            int                     `json:"prompt_tokens"`
@@ -75,14 +184,64 @@ type ResponseMetrics struct {
 	// FirstTokenTime time that llm response is received.
 	FirstTokenTime time.Time
 	// ResponseEndTime after handler completes
-	ResponseEndTime  time.Time
-	Model            string
+	ResponseEndTime time.Time
+	// Streamed is set when the response was a server sent event stream, so FirstTokenTime is
+	// when the first content chunk arrived.
+	Streamed bool
+	// InterTokenLatencies are the gaps between consecutive content chunks of a streamed response.
+	InterTokenLatencies []time.Duration
+	// Model is the model reported by the server in the response.
+	Model string
+	// RequestedModel is the model the client asked for. Servers that only serve one model,
+	// such as llama.cpp, answer with a different model than requested.
+	RequestedModel string
+	// MaxTokens is the max_tokens or max_completion_tokens limit of the request, 0 if unset.
+	MaxTokens int
+	// Temperature and TopP are the sampling parameters of the request, nil if unset.
+	Temperature *float64
+	TopP        *float64
+	// StreamRequested is set when the request asked for a streamed response.
+	StreamRequested bool
+	// MessageCount is the number of chat messages, prompts or embedding inputs sent.
+	MessageCount int
+	// ToolCount is the number of tools offered to the model in the request.
+	ToolCount int
+	// Client is the name of the caller the request is attributed to, empty when callers are
+	// not identified.
+	Client string
+	// Upstream is the name of the upstream the proxy routed the request to.
+	Upstream         string
 	PromptTokens     int
 	CompletionTokens int
 	TotalTokens      int
-	ResponseSize     int64
-	Endpoint         string
-	StatusCode       int
+	// CachedTokens are the prompt tokens served from the prompt cache.
+	CachedTokens int
+	// ReasoningTokens are the completion tokens spent on reasoning.
+	ReasoningTokens int
+	// AcceptedPredictionTokens and RejectedPredictionTokens are the predicted output
+	// tokens that did and did not appear in the completion.
+	AcceptedPredictionTokens int
+	RejectedPredictionTokens int
+	RequestSize              int64
+	ResponseSize             int64
+	Endpoint                 string
+	StatusCode               int
+	// FinishReason is the finish reason of the first choice.
+	FinishReason string
+	// ToolCalls is the number of tool calls across all choices.
+	ToolCalls int
+	// ToolNames are the names of the functions called, one entry per tool call.
+	ToolNames []string
+	// ExtractError is set when metrics could not be extracted from the response body.
+	ExtractError error
+	// ErrorType and ErrorCode are read from the error envelope of a failed request.
+	ErrorType string
+	ErrorCode string
+	// ServerTimings are the inference timings reported by llama.cpp, nil for other servers.
+	ServerTimings *LlamaCppTimings
+	// Labels are caller supplied labels that describe the request. The metrics client records
+	// the ones named with its WithRequestLabels option.
+	Labels map[string]string
 }
 
 // CalculateMetrics computes derived metrics from the response data
@@ -104,19 +263,65 @@ func (rm *ResponseMetrics) CalculateMetrics() map[string]float64 {
 		metrics["prompt_processing_time_ms"] = float64(rm.ResponseStartTime.Sub(rm.RequestStartTime).Nanoseconds()) / 1e6
 	}
 
-	// Token Generation Time
-	if !rm.ResponseEndTime.IsZero() && !rm.FirstTokenTime.IsZero() && rm.CompletionTokens > 0 {
-		totalGenTime := rm.ResponseEndTime.Sub(rm.FirstTokenTime)
+	// Token Generation Time. Without streaming the tokens are not observed as they are
+	// generated, so the whole request is used.
+	genStart := rm.FirstTokenTime
+	if !rm.Streamed {
+		genStart = rm.RequestStartTime
+	}
+	if !rm.ResponseEndTime.IsZero() && !genStart.IsZero() && rm.CompletionTokens > 0 {
+		totalGenTime := rm.ResponseEndTime.Sub(genStart)
 		metrics["token_generation_time_ms"] = float64(totalGenTime.Nanoseconds()) / 1e6
-		metrics["tokens_per_second"] = float64(rm.CompletionTokens) / totalGenTime.Seconds()
+	}
+
+	// Decode throughput, as measured by the server or else between the first and the last
+	// streamed token. A response that is not streamed only gives the time of the whole request,
+	// prompt processing and network included, so it has no throughput.
+	switch {
+	case rm.ServerTimings != nil && rm.ServerTimings.PredictedPerSecond > 0:
+		metrics["tokens_per_second"] = rm.ServerTimings.PredictedPerSecond
+	case rm.Streamed && !rm.FirstTokenTime.IsZero() && rm.CompletionTokens > 1:
+		if decode := rm.ResponseEndTime.Sub(rm.FirstTokenTime); decode >= minDecodeTime {
+			// the first token ends prompt processing, the rest are decoded in this time.
+			metrics["tokens_per_second"] = float64(rm.CompletionTokens-1) / decode.Seconds()
+		}
+	}
+
+	// Server reported inference timings
+	if rm.ServerTimings != nil {
+		metrics["server_prompt_processing_time_ms"] = rm.ServerTimings.PromptMS
+		metrics["server_token_generation_time_ms"] = rm.ServerTimings.PredictedMS
+		metrics["server_prompt_tokens_per_second"] = rm.ServerTimings.PromptPerSecond
+		metrics["server_tokens_per_second"] = rm.ServerTimings.PredictedPerSecond
+		if latency, ok := metrics["api_latency_ms"]; ok {
+			metrics["network_overhead_ms"] = latency - rm.ServerTimings.PromptMS - rm.ServerTimings.PredictedMS
+		}
 	}
 
 	// Token counts
 	metrics["prompt_tokens"] = float64(rm.PromptTokens)
 	metrics["completion_tokens"] = float64(rm.CompletionTokens)
 	metrics["total_tokens"] = float64(rm.TotalTokens)
+	metrics["cached_tokens"] = float64(rm.CachedTokens)
+	metrics["reasoning_tokens"] = float64(rm.ReasoningTokens)
+	metrics["accepted_prediction_tokens"] = float64(rm.AcceptedPredictionTokens)
+	metrics["rejected_prediction_tokens"] = float64(rm.RejectedPredictionTokens)
+	metrics["tool_calls"] = float64(rm.ToolCalls)
+
+	// Request parameters
+	if rm.MaxTokens > 0 {
+		metrics["max_tokens"] = float64(rm.MaxTokens)
+	}
+	metrics["message_count"] = float64(rm.MessageCount)
+	metrics["tool_count"] = float64(rm.ToolCount)
+
+	// Prompt cache hit ratio
+	if rm.PromptTokens > 0 {
+		metrics["prompt_cache_hit_ratio"] = float64(rm.CachedTokens) / float64(rm.PromptTokens)
+	}
 
 	// Request/Response sizes
+	metrics["request_size_bytes"] = float64(rm.RequestSize)
 	metrics["response_size_bytes"] = float64(rm.ResponseSize)
 
 	return metrics
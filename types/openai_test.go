@@ -0,0 +1,63 @@
+package types
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCalculateMetricsTokensPerSecond(t *testing.T) {
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		metrics ResponseMetrics
+		want    float64
+		ok      bool
+	}{
+		{
+			name: "streamed",
+			metrics: ResponseMetrics{
+				Streamed: true, CompletionTokens: 101, RequestStartTime: start,
+				FirstTokenTime: start.Add(time.Second), ResponseEndTime: start.Add(3 * time.Second),
+			},
+			want: 50,
+			ok:   true,
+		},
+		{
+			name: "server timings",
+			metrics: ResponseMetrics{
+				CompletionTokens: 100, RequestStartTime: start, ResponseEndTime: start.Add(10 * time.Second),
+				ServerTimings: &LlamaCppTimings{PredictedPerSecond: 42},
+			},
+			want: 42,
+			ok:   true,
+		},
+		{
+			name: "not streamed",
+			metrics: ResponseMetrics{
+				CompletionTokens: 100, RequestStartTime: start,
+				FirstTokenTime: start.Add(10 * time.Second), ResponseEndTime: start.Add(10 * time.Second),
+			},
+		},
+		{
+			name: "stream arrived in a burst",
+			metrics: ResponseMetrics{
+				Streamed: true, CompletionTokens: 100, RequestStartTime: start,
+				FirstTokenTime: start.Add(time.Second), ResponseEndTime: start.Add(time.Second),
+			},
+		},
+		{
+			name: "single token",
+			metrics: ResponseMetrics{
+				Streamed: true, CompletionTokens: 1, RequestStartTime: start,
+				FirstTokenTime: start.Add(time.Second), ResponseEndTime: start.Add(2 * time.Second),
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, ok := tt.metrics.CalculateMetrics()["tokens_per_second"]
+		if ok != tt.ok || math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: tokens_per_second = %v, %v, want %v, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
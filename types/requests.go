@@ -0,0 +1,63 @@
+package types
+
+import "encoding/json"
+
+// ChatCompletionRequest represents the request body of the OpenAI chat completions API. Only
+// the fields used for metrics are decoded.
+type ChatCompletionRequest struct {
+	Model    string                         `json:"model"`
+	Messages []ChatCompletionRequestMessage `json:"messages"`
+	// MaxTokens is deprecated by OpenAI in favor of MaxCompletionTokens but still sent by
+	// most clients and used by llama.cpp.
+	MaxTokens           *int     `json:"max_tokens,omitempty"`
+	MaxCompletionTokens *int     `json:"max_completion_tokens,omitempty"`
+	Temperature         *float64 `json:"temperature,omitempty"`
+	TopP                *float64 `json:"top_p,omitempty"`
+	Stream              bool     `json:"stream,omitempty"`
+	Tools               []Tool   `json:"tools,omitempty"`
+}
+
+// ChatCompletionRequestMessage represents a message sent in a chat completion request.
+// Content is either a string or an array of content parts, so it is kept as raw json.
+type ChatCompletionRequestMessage struct {
+	Role       string          `json:"role"`
+	Content    json.RawMessage `json:"content,omitempty"`
+	Name       string          `json:"name,omitempty"`
+	ToolCalls  []ToolCall      `json:"tool_calls,omitempty"`
+	ToolCallID string          `json:"tool_call_id,omitempty"`
+}
+
+// Tool represents a tool the model may call.
+type Tool struct {
+	Type     string             `json:"type"`
+	Function FunctionDefinition `json:"function"`
+}
+
+// FunctionDefinition describes a function tool. Parameters is the json schema of the
+// function arguments.
+type FunctionDefinition struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// CompletionRequest represents the request body of the legacy OpenAI text completions API.
+// Prompt is a string, an array of strings or an array of token arrays.
+type CompletionRequest struct {
+	Model       string          `json:"model"`
+	Prompt      json.RawMessage `json:"prompt"`
+	MaxTokens   *int            `json:"max_tokens,omitempty"`
+	Temperature *float64        `json:"temperature,omitempty"`
+	TopP        *float64        `json:"top_p,omitempty"`
+	Stream      bool            `json:"stream,omitempty"`
+	Echo        bool            `json:"echo,omitempty"`
+}
+
+// EmbeddingRequest represents the request body of the OpenAI embeddings API. Input is a
+// string, an array of strings or an array of token arrays.
+type EmbeddingRequest struct {
+	Model          string          `json:"model"`
+	Input          json.RawMessage `json:"input"`
+	EncodingFormat string          `json:"encoding_format,omitempty"`
+	Dimensions     *int            `json:"dimensions,omitempty"`
+}